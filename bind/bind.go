@@ -7,7 +7,10 @@ import (
 	"syscall"
 )
 
-var ErrInvalidIPAddr = errors.New("invalid ip address")
+var (
+	ErrInvalidIPAddr    = errors.New("invalid ip address")
+	ErrMarkNotSupported = errors.New("socket mark is only supported on linux")
+)
 
 func BindToDeviceForConn(ifaceName string, dialer *net.Dialer) error {
 	return bindToDeviceForConn(ifaceName, dialer)
@@ -17,6 +20,17 @@ func BindToDeviceForPacket(ifaceName string, lc *net.ListenConfig) error {
 	return bindToDeviceForPacket(ifaceName, lc)
 }
 
+// SetMarkForConn sets the SO_MARK firewall mark on the sockets of dialer,
+// which requires CAP_NET_ADMIN. It is only supported on Linux.
+func SetMarkForConn(mark uint32, dialer *net.Dialer) error {
+	return setMarkForConn(mark, dialer)
+}
+
+// SetMarkForPacket is SetMarkForConn for the sockets of lc.
+func SetMarkForPacket(mark uint32, lc *net.ListenConfig) error {
+	return setMarkForPacket(mark, lc)
+}
+
 type controlFn = func(ctx context.Context, network, address string, c syscall.RawConn) error
 
 func addControlToListenConfig(lc *net.ListenConfig, fn controlFn) {
@@ -49,3 +49,11 @@ func bindToDeviceForPacket(ifaceName string, lc *net.ListenConfig) error {
 	addControlToListenConfig(lc, setupControl(iface.Index))
 	return nil
 }
+
+func setMarkForConn(mark uint32, dialer *net.Dialer) error {
+	return ErrMarkNotSupported
+}
+
+func setMarkForPacket(mark uint32, lc *net.ListenConfig) error {
+	return ErrMarkNotSupported
+}
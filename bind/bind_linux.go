@@ -44,3 +44,26 @@ func bindToDeviceForPacket(ifaceName string, lc *net.ListenConfig) error {
 	addControlToListenConfig(lc, setupControl(iface.Name))
 	return nil
 }
+
+func setupMarkControl(mark uint32) controlFn {
+	return func(ctx context.Context, network, address string, c syscall.RawConn) (err error) {
+		var innerErr error
+		err = c.Control(func(fd uintptr) {
+			innerErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+		})
+		if innerErr != nil {
+			err = innerErr
+		}
+		return
+	}
+}
+
+func setMarkForConn(mark uint32, dialer *net.Dialer) error {
+	addControlToDialer(dialer, setupMarkControl(mark))
+	return nil
+}
+
+func setMarkForPacket(mark uint32, lc *net.ListenConfig) error {
+	addControlToListenConfig(lc, setupMarkControl(mark))
+	return nil
+}
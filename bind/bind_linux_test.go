@@ -0,0 +1,80 @@
+package bind
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func socketMark(t *testing.T, conn syscall.Conn) int {
+	t.Helper()
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	var innerErr error
+	err = rawConn.Control(func(fd uintptr) {
+		mark, innerErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	})
+	if err == nil {
+		err = innerErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mark
+}
+
+func TestSetMarkForConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var called bool
+	dialer := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			called = true
+			return nil
+		},
+	}
+	if err = SetMarkForConn(0x10, &dialer); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting SO_MARK needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !called {
+		t.Error("the previous control function was not called")
+	}
+	if mark := socketMark(t, conn.(*net.TCPConn)); mark != 0x10 {
+		t.Errorf("unexpected mark 0x%x", mark)
+	}
+}
+
+func TestSetMarkForPacket(t *testing.T) {
+	var lc net.ListenConfig
+	if err := SetMarkForPacket(0x20, &lc); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting SO_MARK needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if mark := socketMark(t, conn.(*net.UDPConn)); mark != 0x20 {
+		t.Errorf("unexpected mark 0x%x", mark)
+	}
+}
@@ -0,0 +1,12 @@
+package tun
+
+import "gvisor.dev/gvisor/pkg/tcpip/faketime"
+
+// ManualClock is a tcpip.Clock that only moves forward when Advance is
+// called. Pass it as StackOptions.Clock to make timer-driven behaviour such
+// as TCP keepalive and retransmission deterministic in tests.
+type ManualClock = faketime.ManualClock
+
+func NewManualClock() *ManualClock {
+	return faketime.NewManualClock()
+}
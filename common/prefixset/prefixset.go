@@ -0,0 +1,270 @@
+// Package prefixset implements immutable sets of IPv4 and IPv6 addresses
+// built from netip.Prefix values.
+//
+// A set is stored as sorted, disjoint address ranges per family, so union,
+// intersection and subtraction run in linear time and lookups in
+// logarithmic time, which keeps sets of hundreds of thousands of prefixes
+// cheap.
+package prefixset
+
+import (
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+type ipRange struct {
+	from, to uint128
+}
+
+// Set is a set of IP addresses. The zero value is an empty set.
+type Set struct {
+	v4 []ipRange
+	v6 []ipRange
+}
+
+// New returns the set of addresses covered by prefixes. Invalid prefixes
+// are ignored, IPv4-mapped IPv6 prefixes are treated as IPv6.
+func New(prefixes ...netip.Prefix) *Set {
+	s := &Set{}
+	for _, prefix := range prefixes {
+		if !prefix.IsValid() {
+			continue
+		}
+		if prefix.Addr().Is4() {
+			s.v4 = append(s.v4, prefixRange(prefix))
+		} else {
+			s.v6 = append(s.v6, prefixRange(prefix))
+		}
+	}
+	s.v4 = normalize(s.v4)
+	s.v6 = normalize(s.v6)
+	return s
+}
+
+func prefixRange(prefix netip.Prefix) ipRange {
+	prefix = prefix.Masked()
+	from := fromAddr(prefix.Addr())
+	return ipRange{
+		from: from,
+		to:   from.or(hostMask(prefix.Addr().BitLen() - prefix.Bits())),
+	}
+}
+
+// normalize sorts ranges and merges the overlapping and adjacent ones.
+func normalize(ranges []ipRange) []ipRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	slices.SortFunc(ranges, func(a, b ipRange) int {
+		return a.from.cmp(b.from)
+	})
+	out := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &out[len(out)-1]
+		if adjacentOrOverlapping(*last, r) {
+			if r.to.cmp(last.to) > 0 {
+				last.to = r.to
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// adjacentOrOverlapping reports whether b, which does not start before a,
+// can be merged into a.
+func adjacentOrOverlapping(a, b ipRange) bool {
+	if b.from.cmp(a.to) <= 0 {
+		return true
+	}
+	return a.to != maxUint128 && b.from == a.to.addOne()
+}
+
+// IsEmpty reports whether s contains no address.
+func (s *Set) IsEmpty() bool {
+	return len(s.v4) == 0 && len(s.v6) == 0
+}
+
+// Equal reports whether s and o contain the same addresses.
+func (s *Set) Equal(o *Set) bool {
+	return slices.Equal(s.v4, o.v4) && slices.Equal(s.v6, o.v6)
+}
+
+// Union returns the addresses contained in s or o.
+func (s *Set) Union(o *Set) *Set {
+	return &Set{v4: union(s.v4, o.v4), v6: union(s.v6, o.v6)}
+}
+
+// Intersect returns the addresses contained in both s and o.
+func (s *Set) Intersect(o *Set) *Set {
+	return &Set{v4: intersect(s.v4, o.v4), v6: intersect(s.v6, o.v6)}
+}
+
+// Subtract returns the addresses contained in s but not in o.
+func (s *Set) Subtract(o *Set) *Set {
+	return &Set{v4: subtract(s.v4, o.v4), v6: subtract(s.v6, o.v6)}
+}
+
+func (s *Set) family(addr netip.Addr) []ipRange {
+	if addr.Is4() {
+		return s.v4
+	}
+	return s.v6
+}
+
+// search returns the first range of ranges that ends at or after u.
+func search(ranges []ipRange, u uint128) int {
+	return sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].to.cmp(u) >= 0
+	})
+}
+
+// Contains reports whether addr is in s.
+func (s *Set) Contains(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	ranges := s.family(addr)
+	u := fromAddr(addr)
+	i := search(ranges, u)
+	return i < len(ranges) && ranges[i].from.cmp(u) <= 0
+}
+
+// ContainsPrefix reports whether every address of prefix is in s.
+func (s *Set) ContainsPrefix(prefix netip.Prefix) bool {
+	if !prefix.IsValid() {
+		return false
+	}
+	ranges := s.family(prefix.Addr())
+	r := prefixRange(prefix)
+	i := search(ranges, r.from)
+	return i < len(ranges) && ranges[i].from.cmp(r.from) <= 0 && ranges[i].to.cmp(r.to) >= 0
+}
+
+// Overlaps reports whether any address of prefix is in s.
+func (s *Set) Overlaps(prefix netip.Prefix) bool {
+	if !prefix.IsValid() {
+		return false
+	}
+	ranges := s.family(prefix.Addr())
+	r := prefixRange(prefix)
+	i := search(ranges, r.from)
+	return i < len(ranges) && ranges[i].from.cmp(r.to) <= 0
+}
+
+// Prefixes returns the minimal sorted list of prefixes covering s, IPv4
+// before IPv6.
+func (s *Set) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range s.v4 {
+		prefixes = appendPrefixes(prefixes, r, true)
+	}
+	for _, r := range s.v6 {
+		prefixes = appendPrefixes(prefixes, r, false)
+	}
+	return prefixes
+}
+
+// appendPrefixes splits r into the largest aligned blocks it contains.
+func appendPrefixes(prefixes []netip.Prefix, r ipRange, is4 bool) []netip.Prefix {
+	bitLen := 128
+	if is4 {
+		bitLen = 32
+	}
+	from := r.from
+	for {
+		hostBits := min(from.trailingZeros(), bitLen)
+		for hostBits > 0 && from.or(hostMask(hostBits)).cmp(r.to) > 0 {
+			hostBits--
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(from.addr(is4), bitLen-hostBits))
+		last := from.or(hostMask(hostBits))
+		if last.cmp(r.to) >= 0 {
+			return prefixes
+		}
+		from = last.addOne()
+	}
+}
+
+func union(a, b []ipRange) []ipRange {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	out := make([]ipRange, 0, len(a)+len(b))
+	var i, j int
+	for i < len(a) || j < len(b) {
+		var next ipRange
+		if j == len(b) || (i < len(a) && a[i].from.cmp(b[j].from) <= 0) {
+			next = a[i]
+			i++
+		} else {
+			next = b[j]
+			j++
+		}
+		if len(out) > 0 && adjacentOrOverlapping(out[len(out)-1], next) {
+			if next.to.cmp(out[len(out)-1].to) > 0 {
+				out[len(out)-1].to = next.to
+			}
+			continue
+		}
+		out = append(out, next)
+	}
+	return out
+}
+
+func intersect(a, b []ipRange) []ipRange {
+	var out []ipRange
+	var i, j int
+	for i < len(a) && j < len(b) {
+		from, to := a[i].from, a[i].to
+		if b[j].from.cmp(from) > 0 {
+			from = b[j].from
+		}
+		if b[j].to.cmp(to) < 0 {
+			to = b[j].to
+		}
+		if from.cmp(to) <= 0 {
+			out = append(out, ipRange{from: from, to: to})
+		}
+		if a[i].to.cmp(b[j].to) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
+
+func subtract(a, b []ipRange) []ipRange {
+	if len(a) == 0 || len(b) == 0 {
+		return a
+	}
+	var out []ipRange
+	var j int
+	for _, r := range a {
+		for j < len(b) && b[j].to.cmp(r.from) < 0 {
+			j++
+		}
+		from := r.from
+		covered := false
+		for k := j; k < len(b) && b[k].from.cmp(r.to) <= 0; k++ {
+			if b[k].from.cmp(from) > 0 {
+				out = append(out, ipRange{from: from, to: b[k].from.subOne()})
+			}
+			if b[k].to.cmp(r.to) >= 0 {
+				covered = true
+				break
+			}
+			from = b[k].to.addOne()
+		}
+		if !covered {
+			out = append(out, ipRange{from: from, to: r.to})
+		}
+	}
+	return out
+}
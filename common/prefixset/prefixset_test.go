@@ -0,0 +1,164 @@
+package prefixset
+
+import (
+	"math/rand"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func parsePrefixes(t testing.TB, s ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(s))
+	for _, p := range s {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func assertPrefixes(t *testing.T, s *Set, expected ...string) {
+	t.Helper()
+	got := s.Prefixes()
+	if !slices.Equal(got, parsePrefixes(t, expected...)) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestNewMerges(t *testing.T) {
+	assertPrefixes(t, New(parsePrefixes(t,
+		"10.0.1.0/24", "10.0.0.0/24", "10.0.0.128/25", "fd00::/9", "fd80::/9",
+	)...), "10.0.0.0/23", "fd00::/8")
+	assertPrefixes(t, New(parsePrefixes(t, "0.0.0.0/1", "128.0.0.0/1", "::/0", "::1/128")...), "0.0.0.0/0", "::/0")
+	if !New().IsEmpty() || !(&Set{}).IsEmpty() {
+		t.Fatal("expected empty set")
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	all := New(parsePrefixes(t, "0.0.0.0/0", "::/0")...)
+	assertPrefixes(t, all.Subtract(New(parsePrefixes(t, "0.0.0.0/8", "::/8")...)),
+		"1.0.0.0/8", "2.0.0.0/7", "4.0.0.0/6", "8.0.0.0/5", "16.0.0.0/4", "32.0.0.0/3", "64.0.0.0/2", "128.0.0.0/1",
+		"100::/8", "200::/7", "400::/6", "800::/5", "1000::/4", "2000::/3", "4000::/2", "8000::/1",
+	)
+	assertPrefixes(t, New(parsePrefixes(t, "10.0.0.0/8")...).Subtract(New(parsePrefixes(t, "10.0.0.0/9", "10.192.0.0/10")...)),
+		"10.128.0.0/10")
+	assertPrefixes(t, New(parsePrefixes(t, "10.0.0.0/24")...).Subtract(New(parsePrefixes(t, "10.0.0.0/8")...)))
+	assertPrefixes(t, New(parsePrefixes(t, "10.0.0.0/30")...).Subtract(New(parsePrefixes(t, "10.0.0.1/32", "10.0.0.2/32")...)),
+		"10.0.0.0/32", "10.0.0.3/32")
+}
+
+func TestUnionIntersect(t *testing.T) {
+	a := New(parsePrefixes(t, "10.0.0.0/24", "192.168.0.0/16", "fd00::/8")...)
+	b := New(parsePrefixes(t, "10.0.1.0/24", "192.168.1.0/24", "2001:db8::/32")...)
+	assertPrefixes(t, a.Union(b), "10.0.0.0/23", "192.168.0.0/16", "2001:db8::/32", "fd00::/8")
+	assertPrefixes(t, a.Intersect(b), "192.168.1.0/24")
+	if !a.Union(b).Equal(b.Union(a)) {
+		t.Fatal("union is not commutative")
+	}
+}
+
+func TestContains(t *testing.T) {
+	s := New(parsePrefixes(t, "10.0.0.0/8", "fd00::/8", "::ffff:1.1.1.1/128")...)
+	for _, addr := range []string{"10.0.0.1", "10.255.255.255", "fdff::1", "::ffff:1.1.1.1"} {
+		if !s.Contains(netip.MustParseAddr(addr)) {
+			t.Fatal("expected to contain", addr)
+		}
+	}
+	for _, addr := range []string{"11.0.0.0", "9.255.255.255", "fe00::", "1.1.1.1"} {
+		if s.Contains(netip.MustParseAddr(addr)) {
+			t.Fatal("unexpected", addr)
+		}
+	}
+	if !s.ContainsPrefix(netip.MustParsePrefix("10.1.0.0/16")) || s.ContainsPrefix(netip.MustParsePrefix("10.0.0.0/7")) {
+		t.Fatal("unexpected ContainsPrefix result")
+	}
+	if !s.Overlaps(netip.MustParsePrefix("10.0.0.0/7")) || s.Overlaps(netip.MustParsePrefix("11.0.0.0/8")) {
+		t.Fatal("unexpected Overlaps result")
+	}
+}
+
+// TestRandom checks every operation against a bitmap of a small address
+// space.
+func TestRandom(t *testing.T) {
+	const bits = 12
+	random := rand.New(rand.NewSource(1))
+	randomPrefixes := func() ([]netip.Prefix, []bool) {
+		var prefixes []netip.Prefix
+		bitmap := make([]bool, 1<<bits)
+		for i := random.Intn(8); i > 0; i-- {
+			prefixBits := 32 - random.Intn(bits+1)
+			from := random.Intn(1 << bits)
+			prefix := netip.PrefixFrom(uint128{lo: uint64(from)}.addr(true), prefixBits).Masked()
+			prefixes = append(prefixes, prefix)
+			start := int(fromAddr(prefix.Addr()).lo)
+			for j := 0; j < 1<<(32-prefixBits); j++ {
+				bitmap[start+j] = true
+			}
+		}
+		return prefixes, bitmap
+	}
+	check := func(s *Set, expected func(int) bool) {
+		t.Helper()
+		covered := make([]bool, 1<<bits)
+		for _, prefix := range s.Prefixes() {
+			start := int(fromAddr(prefix.Addr()).lo)
+			for j := 0; j < 1<<(32-prefix.Bits()); j++ {
+				if covered[start+j] {
+					t.Fatal("overlapping prefixes:", s.Prefixes())
+				}
+				covered[start+j] = true
+			}
+		}
+		for i := range covered {
+			if covered[i] != expected(i) {
+				t.Fatal("mismatch at", i, s.Prefixes())
+			}
+			if s.Contains(uint128{lo: uint64(i)}.addr(true)) != covered[i] {
+				t.Fatal("Contains mismatch at", i)
+			}
+		}
+		if !New(s.Prefixes()...).Equal(s) {
+			t.Fatal("round trip mismatch")
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		a, bitmapA := randomPrefixes()
+		b, bitmapB := randomPrefixes()
+		setA, setB := New(a...), New(b...)
+		check(setA.Union(setB), func(i int) bool { return bitmapA[i] || bitmapB[i] })
+		check(setA.Intersect(setB), func(i int) bool { return bitmapA[i] && bitmapB[i] })
+		check(setA.Subtract(setB), func(i int) bool { return bitmapA[i] && !bitmapB[i] })
+	}
+}
+
+func randomSet(random *rand.Rand, n int) *Set {
+	prefixes := make([]netip.Prefix, 0, n)
+	for i := 0; i < n; i++ {
+		prefixes = append(prefixes, netip.PrefixFrom(uint128{lo: uint64(random.Uint32())}.addr(true), 16+random.Intn(17)).Masked())
+		var b [16]byte
+		random.Read(b[:])
+		prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom16(b), 32+random.Intn(97)).Masked())
+	}
+	return New(prefixes...)
+}
+
+func BenchmarkSubtract(b *testing.B) {
+	random := rand.New(rand.NewSource(1))
+	setA, setB := randomSet(random, 100000), randomSet(random, 100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = setA.Subtract(setB).Prefixes()
+	}
+}
+
+func BenchmarkNew(b *testing.B) {
+	random := rand.New(rand.NewSource(1))
+	prefixes := randomSet(random, 100000).Prefixes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = New(prefixes...)
+	}
+}
@@ -4,8 +4,10 @@ go 1.23.0
 
 require (
 	github.com/go-ole/go-ole v1.3.0
+	github.com/google/nftables v0.2.1-0.20240414091927-5e242ec57806
 	github.com/mdlayher/netlink v1.7.2
 	github.com/vishvananda/netlink v1.3.0
+	github.com/vishvananda/netns v0.0.4
 	golang.org/x/net v0.26.0
 	golang.org/x/sys v0.21.0
 	gvisor.dev/gvisor v0.0.0-20240622015726-dfeb44ecf5ac
@@ -13,10 +15,9 @@ require (
 
 require (
 	github.com/google/btree v1.1.2 // indirect
-	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/josharian/native v1.1.0 // indirect
-	github.com/mdlayher/socket v0.4.1 // indirect
-	github.com/vishvananda/netns v0.0.4 // indirect
+	github.com/mdlayher/socket v0.5.0 // indirect
 	golang.org/x/sync v0.6.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 )
@@ -1,5 +1,7 @@
 package tun
 
+import "gvisor.dev/gvisor/pkg/tcpip"
+
 type Stack interface {
 	Start() error
 	Close() error
@@ -10,6 +12,9 @@ type StackOptions struct {
 	Tun        Tun
 	TunOptions *Options
 	Handler    Handler
+	// Clock drives the stack's timers (keepalive, retransmission, UDP idle
+	// timeouts). If nil, the real clock is used.
+	Clock tcpip.Clock
 }
 
 func NewStack(options StackOptions) (Stack, error) {
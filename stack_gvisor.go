@@ -44,8 +44,10 @@ func (c *udpOnceCloser) Close() error {
 }
 
 type GVisor struct {
-	tun      GVisorTun
+	tun      Tun
+	mtu      uint32
 	handler  Handler
+	clock    tcpip.Clock
 	stack    *stack.Stack
 	endpoint stack.LinkEndpoint
 }
@@ -55,22 +57,51 @@ type GVisorTun interface {
 	NewEndpoint() (stack.LinkEndpoint, error)
 }
 
+var (
+	ErrNilTun     = errors.New("tun device is nil")
+	ErrNilHandler = errors.New("handler is nil")
+)
+
 func newGVisor(options StackOptions) (Stack, error) {
+	if options.Tun == nil {
+		return nil, ErrNilTun
+	}
+	if options.Handler == nil {
+		return nil, ErrNilHandler
+	}
 	gStack := &GVisor{
-		tun:     options.Tun.(GVisorTun),
+		tun:     options.Tun,
 		handler: options.Handler,
+		clock:   options.Clock,
+	}
+	if options.TunOptions != nil {
+		gStack.mtu = options.TunOptions.MTU
 	}
 	return gStack, nil
 }
 
 func (t *GVisor) TunDevice() Tun { return t.tun }
 
+// newEndpoint prefers the platform specific endpoint of the tun device and
+// falls back to a GenericEndpoint for any other Tun implementation.
+func (t *GVisor) newEndpoint() (stack.LinkEndpoint, error) {
+	if gTun, ok := t.tun.(GVisorTun); ok {
+		return gTun.NewEndpoint()
+	}
+	return NewGenericEndpoint(t.tun, t.mtu), nil
+}
+
 func (t *GVisor) Start() error {
-	linkEndpoint, err := t.tun.NewEndpoint()
+	linkEndpoint, err := t.newEndpoint()
 	if err != nil {
 		return err
 	}
-	ipStack, err := newGVisorStack(linkEndpoint)
+	if relink, ok := t.tun.(relinkTun); ok {
+		switchEndpoint := newSwitchEndpoint(linkEndpoint)
+		relink.setRelinkHandler(switchEndpoint.Switch)
+		linkEndpoint = switchEndpoint
+	}
+	ipStack, err := newGVisorStack(linkEndpoint, t.clock)
 	if err != nil {
 		return err
 	}
@@ -174,8 +205,9 @@ func AddrFromAddress(address tcpip.Address) netip.Addr {
 	}
 }
 
-func newGVisorStack(ep stack.LinkEndpoint) (*stack.Stack, error) {
+func newGVisorStack(ep stack.LinkEndpoint, clock tcpip.Clock) (*stack.Stack, error) {
 	ipStack := stack.New(stack.Options{
+		Clock: clock,
 		NetworkProtocols: []stack.NetworkProtocolFactory{
 			ipv4.NewProtocol,
 			ipv6.NewProtocol,
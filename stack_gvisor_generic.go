@@ -0,0 +1,180 @@
+package tun
+
+import (
+	"sync"
+
+	"github.com/josexy/cropstun/common/buf"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var _ stack.LinkEndpoint = (*GenericEndpoint)(nil)
+
+// GenericEndpoint is a platform independent link endpoint for any Tun that
+// reads and writes raw IP packets without a link layer header. It is used
+// by the gVisor stack when the Tun does not implement GVisorTun.
+type GenericEndpoint struct {
+	tun        Tun
+	mtu        uint32
+	access     sync.RWMutex
+	dispatcher stack.NetworkDispatcher
+	running    sync.WaitGroup
+}
+
+func NewGenericEndpoint(tun Tun, mtu uint32) *GenericEndpoint {
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	return &GenericEndpoint{tun: tun, mtu: mtu}
+}
+
+func (e *GenericEndpoint) MTU() uint32 {
+	return e.mtu
+}
+
+func (e *GenericEndpoint) Close() {
+	_ = e.tun.Close()
+}
+
+func (e *GenericEndpoint) SetLinkAddress(addr tcpip.LinkAddress) {
+}
+
+func (e *GenericEndpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+func (e *GenericEndpoint) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+func (e *GenericEndpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return stack.CapabilityRXChecksumOffload
+}
+
+func (e *GenericEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.attach(dispatcher, func() {
+		e.spawn(e.dispatchLoop)
+	})
+}
+
+// attach sets the dispatcher and calls start if the endpoint was detached.
+func (e *GenericEndpoint) attach(dispatcher stack.NetworkDispatcher, start func()) {
+	e.access.Lock()
+	defer e.access.Unlock()
+	if dispatcher == nil {
+		e.dispatcher = nil
+		return
+	}
+	if e.dispatcher == nil {
+		e.dispatcher = dispatcher
+		start()
+	}
+}
+
+// spawn runs a dispatch loop that Wait waits for.
+func (e *GenericEndpoint) spawn(loop func()) {
+	e.running.Add(1)
+	go func() {
+		defer e.running.Done()
+		loop()
+	}()
+}
+
+func (e *GenericEndpoint) dispatchLoop() {
+	packetBuffer := make([]byte, e.mtu)
+	for {
+		n, err := e.tun.Read(packetBuffer)
+		if err != nil {
+			break
+		}
+		if !e.deliverPacket(packetBuffer[:n]) {
+			return
+		}
+	}
+}
+
+// deliverPacket passes an IP packet to the dispatcher, skipping anything
+// else. It returns false once the endpoint is detached.
+func (e *GenericEndpoint) deliverPacket(packet []byte) bool {
+	pkt := newPacketBuffer(packet)
+	if pkt == nil {
+		return true
+	}
+	defer pkt.DecRef()
+	return e.deliver(pkt)
+}
+
+// deliver passes pkt to the dispatcher. It returns false once the endpoint
+// is detached.
+func (e *GenericEndpoint) deliver(pkt *stack.PacketBuffer) bool {
+	e.access.RLock()
+	dispatcher := e.dispatcher
+	e.access.RUnlock()
+	if dispatcher == nil {
+		return false
+	}
+	dispatcher.DeliverNetworkPacket(pkt.NetworkProtocolNumber, pkt)
+	return true
+}
+
+// newPacketBuffer copies an IP packet into a packet buffer, and returns nil
+// for anything else.
+func newPacketBuffer(packet []byte) *stack.PacketBuffer {
+	var networkProtocol tcpip.NetworkProtocolNumber
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		networkProtocol = header.IPv4ProtocolNumber
+	case header.IPv6Version:
+		networkProtocol = header.IPv6ProtocolNumber
+	default:
+		return nil
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload:           buffer.MakeWithData(packet),
+		IsForwardedPacket: true,
+	})
+	pkt.NetworkProtocolNumber = networkProtocol
+	return pkt
+}
+
+func (e *GenericEndpoint) IsAttached() bool {
+	e.access.RLock()
+	defer e.access.RUnlock()
+	return e.dispatcher != nil
+}
+
+// Wait waits for the dispatch loops, which stop once the endpoint is
+// detached and their pending read returns, or once the tun is closed.
+func (e *GenericEndpoint) Wait() {
+	e.running.Wait()
+}
+
+func (e *GenericEndpoint) ARPHardwareType() header.ARPHardwareType {
+	return header.ARPHardwareNone
+}
+
+func (e *GenericEndpoint) AddHeader(buffer *stack.PacketBuffer) {
+}
+
+func (e *GenericEndpoint) ParseHeader(ptr *stack.PacketBuffer) bool {
+	return true
+}
+
+func (e *GenericEndpoint) WritePackets(packetBufferList stack.PacketBufferList) (int, tcpip.Error) {
+	var n int
+	for _, packet := range packetBufferList.AsSlice() {
+		slices := packet.AsSlices()
+		buffers := make([]*buf.Buffer, 0, len(slices))
+		for _, p := range slices {
+			buffers = append(buffers, buf.As(p))
+		}
+		err := e.tun.WriteVectorised(buffers)
+		if err != nil {
+			return n, &tcpip.ErrAborted{}
+		}
+		n++
+	}
+	return n, nil
+}
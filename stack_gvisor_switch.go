@@ -0,0 +1,129 @@
+package tun
+
+import (
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var (
+	_ stack.LinkEndpoint = (*switchEndpoint)(nil)
+	_ stack.GSOEndpoint  = (*switchEndpoint)(nil)
+)
+
+// relinkTun is a GVisorTun whose device can be recreated while the stack is
+// running. The stack registers a handler that receives the endpoint of the
+// new device.
+type relinkTun interface {
+	GVisorTun
+	setRelinkHandler(handler func(stack.LinkEndpoint))
+}
+
+// switchEndpoint forwards to a link endpoint that can be replaced without
+// removing the NIC from the stack, so that the connections of the stack
+// survive the recreation of the tun device.
+type switchEndpoint struct {
+	access     sync.RWMutex
+	endpoint   stack.LinkEndpoint
+	dispatcher stack.NetworkDispatcher
+}
+
+func newSwitchEndpoint(endpoint stack.LinkEndpoint) *switchEndpoint {
+	return &switchEndpoint{endpoint: endpoint}
+}
+
+// Switch attaches endpoint in place of the current endpoint, and returns
+// once the current endpoint has stopped delivering packets.
+func (e *switchEndpoint) Switch(endpoint stack.LinkEndpoint) {
+	e.access.Lock()
+	oldEndpoint := e.endpoint
+	e.endpoint = endpoint
+	if e.dispatcher != nil {
+		endpoint.Attach(e.dispatcher)
+	}
+	e.access.Unlock()
+	// the dispatchers of the old endpoint may be writing through e, so
+	// they are stopped without holding the lock
+	oldEndpoint.Attach(nil)
+	oldEndpoint.Wait()
+}
+
+func (e *switchEndpoint) current() stack.LinkEndpoint {
+	e.access.RLock()
+	defer e.access.RUnlock()
+	return e.endpoint
+}
+
+func (e *switchEndpoint) MTU() uint32 {
+	return e.current().MTU()
+}
+
+func (e *switchEndpoint) Close() {
+	e.current().Close()
+}
+
+func (e *switchEndpoint) SetLinkAddress(addr tcpip.LinkAddress) {
+	e.current().SetLinkAddress(addr)
+}
+
+func (e *switchEndpoint) MaxHeaderLength() uint16 {
+	return e.current().MaxHeaderLength()
+}
+
+func (e *switchEndpoint) LinkAddress() tcpip.LinkAddress {
+	return e.current().LinkAddress()
+}
+
+func (e *switchEndpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.current().Capabilities()
+}
+
+func (e *switchEndpoint) GSOMaxSize() uint32 {
+	if endpoint, ok := e.current().(stack.GSOEndpoint); ok {
+		return endpoint.GSOMaxSize()
+	}
+	return 0
+}
+
+func (e *switchEndpoint) SupportedGSO() stack.SupportedGSO {
+	if endpoint, ok := e.current().(stack.GSOEndpoint); ok {
+		return endpoint.SupportedGSO()
+	}
+	return stack.GSONotSupported
+}
+
+func (e *switchEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.access.Lock()
+	e.dispatcher = dispatcher
+	endpoint := e.endpoint
+	e.access.Unlock()
+	endpoint.Attach(dispatcher)
+}
+
+func (e *switchEndpoint) IsAttached() bool {
+	return e.current().IsAttached()
+}
+
+func (e *switchEndpoint) Wait() {
+	e.current().Wait()
+}
+
+func (e *switchEndpoint) ARPHardwareType() header.ARPHardwareType {
+	return e.current().ARPHardwareType()
+}
+
+func (e *switchEndpoint) AddHeader(buffer *stack.PacketBuffer) {
+	e.current().AddHeader(buffer)
+}
+
+func (e *switchEndpoint) ParseHeader(ptr *stack.PacketBuffer) bool {
+	return e.current().ParseHeader(ptr)
+}
+
+func (e *switchEndpoint) WritePackets(packetBufferList stack.PacketBufferList) (int, tcpip.Error) {
+	e.access.RLock()
+	defer e.access.RUnlock()
+	return e.endpoint.WritePackets(packetBufferList)
+}
@@ -0,0 +1,257 @@
+package tun
+
+import (
+	"io"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/josexy/cropstun/common/buf"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+type chanTun struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+}
+
+func newChanTun() *chanTun {
+	return &chanTun{
+		in:     make(chan []byte, 16),
+		out:    make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (t *chanTun) Read(p []byte) (int, error) {
+	select {
+	case packet := <-t.in:
+		return copy(p, packet), nil
+	case <-t.closed:
+		return 0, io.EOF
+	}
+}
+
+func (t *chanTun) Write(p []byte) (int, error) {
+	t.out <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (t *chanTun) WriteVectorised(buffers []*buf.Buffer) error {
+	defer buf.ReleaseMulti(buffers)
+	packet := make([]byte, buf.LenMulti(buffers))
+	buf.CopyMulti(packet, buffers)
+	_, err := t.Write(packet)
+	return err
+}
+
+func (t *chanTun) Close() error {
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+	}
+	return nil
+}
+
+func (t *chanTun) SetupDNS([]netip.Addr) error { return nil }
+func (t *chanTun) TeardownDNS() error          { return nil }
+
+type udpEchoHandler struct {
+	metadata chan Metadata
+}
+
+func (h *udpEchoHandler) HandleTCPConnection(conn TCPConn, _ Metadata) error {
+	return conn.Close()
+}
+
+func (h *udpEchoHandler) HandleUDPConnection(conn UDPConn, metadata Metadata) error {
+	h.metadata <- metadata
+	return nil
+}
+
+func buildUDPPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	packet := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+	ip := header.IPv4(packet)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(packet)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     AddressFromAddr(src.Addr()),
+		DstAddr:     AddressFromAddr(dst.Addr()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	udp := header.UDP(packet[header.IPv4MinimumSize:])
+	udp.Encode(&header.UDPFields{
+		SrcPort: src.Port(),
+		DstPort: dst.Port(),
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(udp.Payload(), payload)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), udp.Length())
+	udp.SetChecksum(^udp.CalculateChecksum(checksum.Checksum(payload, xsum)))
+	return packet
+}
+
+func TestGVisorGenericEndpoint(t *testing.T) {
+	tunDev := newChanTun()
+	handler := &udpEchoHandler{metadata: make(chan Metadata, 1)}
+	s, err := NewStack(StackOptions{
+		Tun:     tunDev,
+		Handler: handler,
+		Clock:   NewManualClock(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	src := netip.MustParseAddrPort("198.18.0.2:40000")
+	dst := netip.MustParseAddrPort("1.1.1.1:53")
+	tunDev.in <- buildUDPPacket(src, dst, []byte("hello"))
+
+	select {
+	case metadata := <-handler.metadata:
+		if metadata.Source != src || metadata.Destination != dst {
+			t.Fatalf("unexpected metadata: %v -> %v", metadata.Source, metadata.Destination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("udp connection was not handled")
+	}
+}
+
+func TestNewStackNilTun(t *testing.T) {
+	_, err := NewStack(StackOptions{Handler: &udpEchoHandler{}})
+	if err != ErrNilTun {
+		t.Fatalf("expected ErrNilTun, got %v", err)
+	}
+}
+
+type relinkChanTun struct {
+	*chanTun
+	handler func(stack.LinkEndpoint)
+}
+
+func (t *relinkChanTun) NewEndpoint() (stack.LinkEndpoint, error) {
+	return NewGenericEndpoint(t.chanTun, 0), nil
+}
+
+func (t *relinkChanTun) setRelinkHandler(handler func(stack.LinkEndpoint)) {
+	t.handler = handler
+}
+
+func TestGVisorRelink(t *testing.T) {
+	tunDev := &relinkChanTun{chanTun: newChanTun()}
+	handler := &udpEchoHandler{metadata: make(chan Metadata, 1)}
+	s, err := NewStack(StackOptions{
+		Tun:     tunDev,
+		Handler: handler,
+		Clock:   NewManualClock(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if tunDev.handler == nil {
+		t.Fatal("relink handler was not registered")
+	}
+
+	oldTun := tunDev.chanTun
+	tunDev.chanTun = newChanTun()
+	newEndpoint, _ := tunDev.NewEndpoint()
+	// the old endpoint stops after its pending read returns
+	oldTun.Close()
+	tunDev.handler(newEndpoint)
+
+	src := netip.MustParseAddrPort("198.18.0.2:40000")
+	dst := netip.MustParseAddrPort("1.1.1.1:53")
+	tunDev.in <- buildUDPPacket(src, dst, []byte("hello"))
+
+	select {
+	case metadata := <-handler.metadata:
+		if metadata.Source != src || metadata.Destination != dst {
+			t.Fatalf("unexpected metadata: %v -> %v", metadata.Source, metadata.Destination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("udp connection was not handled by the new endpoint")
+	}
+}
+
+type countDispatcher struct {
+	packets atomic.Int32
+}
+
+func (d *countDispatcher) DeliverNetworkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
+	d.packets.Add(1)
+}
+
+func (d *countDispatcher) DeliverLinkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
+}
+
+func TestGenericEndpointDetach(t *testing.T) {
+	tunDev := newChanTun()
+	endpoint := NewGenericEndpoint(tunDev, 0)
+	dispatcher := &countDispatcher{}
+	endpoint.Attach(dispatcher)
+	if !endpoint.IsAttached() {
+		t.Fatal("endpoint is not attached")
+	}
+	packet := buildUDPPacket(netip.MustParseAddrPort("198.18.0.2:40000"), netip.MustParseAddrPort("1.1.1.1:53"), nil)
+	tunDev.in <- packet
+	for dispatcher.packets.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// detach while the dispatch loop is delivering
+	go func() {
+		for i := 0; i < 8; i++ {
+			tunDev.in <- packet
+		}
+	}()
+	endpoint.Attach(nil)
+	if endpoint.IsAttached() {
+		t.Fatal("endpoint is still attached")
+	}
+	waited := make(chan struct{})
+	go func() {
+		endpoint.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch loop did not stop after detach")
+	}
+
+	// Wait returns only once the pending read of the loop returns
+	readingTun := newChanTun()
+	readingEndpoint := NewGenericEndpoint(readingTun, 0)
+	readingEndpoint.Attach(dispatcher)
+	readingEndpoint.Attach(nil)
+	stopped := make(chan struct{})
+	go func() {
+		readingEndpoint.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Wait returned while the dispatch loop was reading")
+	case <-time.After(50 * time.Millisecond):
+	}
+	readingTun.Close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch loop did not stop after the tun was closed")
+	}
+}
@@ -62,13 +62,78 @@ const (
 )
 
 type Options struct {
-	Name               string
-	Inet4Address       []netip.Prefix
-	Inet6Address       []netip.Prefix
-	MTU                uint32
+	Name         string
+	Inet4Address []netip.Prefix
+	Inet6Address []netip.Prefix
+	MTU          uint32
+	// IPRoute2TableIndex and IPRoute2RuleIndex are allocated on Linux if zero.
 	IPRoute2TableIndex int
 	IPRoute2RuleIndex  int
 	AutoRoute          bool
+	// FileDescriptor adopts an already configured Linux tun device.
+	FileDescriptor *int
+	// Queues is the number of IFF_MULTI_QUEUE queues on Linux.
+	Queues int
+	// GSO enables IFF_VNET_HDR offloads on Linux.
+	GSO bool
+	// Dispatchers is the number of goroutines delivering each Linux queue.
+	Dispatchers int
+	// GSOMaxSize caps GSO segments, 64 KiB if zero.
+	GSOMaxSize uint32
+	// NetNS is the path of the network namespace of the Linux tun device.
+	NetNS string
+	// IncludeUID and ExcludeUID select Linux auto-route by socket owner.
+	IncludeUID []UIDRange
+	ExcludeUID []UIDRange
+	// IncludeInterface, ExcludeInterface, IncludeSource and ExcludeSource
+	// select Linux auto-route by inbound interface and source.
+	IncludeInterface []string
+	ExcludeInterface []string
+	IncludeSource    []netip.Prefix
+	ExcludeSource    []netip.Prefix
+	// IncludeCgroup and ExcludeCgroup select Linux auto-route by cgroup v2 path.
+	IncludeCgroup []string
+	ExcludeCgroup []string
+	// IncludeCgroupMark marks IncludeCgroup traffic, IPRoute2TableIndex if zero.
+	IncludeCgroupMark uint32
+	// RouteAddress and RouteExcludeAddress narrow the ranges of auto-route.
+	RouteAddress        []netip.Prefix
+	RouteExcludeAddress []netip.Prefix
+	// OutboundMark exempts marked packets from Linux auto-route.
+	OutboundMark uint32
+	// StrictRoute blocks routed traffic that would bypass the Linux tun.
+	StrictRoute bool
+	// KillSwitch keeps routed traffic blocked after Close until ReleaseKillSwitch.
+	KillSwitch bool
+	// StatePath journals the Linux changes for Cleanup.
+	StatePath string
+	// Owner and Group may open the Linux tun device without CAP_NET_ADMIN.
+	Owner uint32
+	Group uint32
+	// Persist keeps the Linux tun device after Close.
+	Persist bool
+	// TxQueueLen sets the transmit queue length of the Linux tun device.
+	TxQueueLen int
+	// Attach opens the existing Linux tun device Name.
+	Attach bool
+	// GatewayInterface forwards the LAN behind these interfaces to the tun.
+	GatewayInterface []string
+	// ExcludePort keeps these destination ports out of Linux auto-route.
+	ExcludePort []PortRange
+	// ReturnInbound routes replies to inbound connections outside the Linux tun.
+	ReturnInbound bool
+}
+
+// UIDRange is an inclusive range of user IDs.
+type UIDRange struct {
+	Start uint32
+	End   uint32
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start uint16
+	End   uint16
 }
 
 func NewTunDevice(cidrs []netip.Prefix, options *Options) (Tun, error) {
@@ -78,12 +143,6 @@ func NewTunDevice(cidrs []netip.Prefix, options *Options) (Tun, error) {
 	if options.MTU == 0 {
 		options.MTU = DefaultMTU
 	}
-	if options.IPRoute2TableIndex <= 0 {
-		options.IPRoute2TableIndex = DefaultIPRoute2TableIndex
-	}
-	if options.IPRoute2RuleIndex <= 0 {
-		options.IPRoute2RuleIndex = DefaultIPRoute2RuleIndex
-	}
 	for _, cidr := range cidrs {
 		if cidr.Addr().Is4() {
 			options.Inet4Address = append(options.Inet4Address, cidr)
@@ -1,17 +1,23 @@
 package tun
 
 import (
-	"math/rand"
+	"errors"
 	"net"
 	"net/netip"
 	"os"
 	"os/exec"
+	"slices"
+	"sync"
 	"unsafe"
 
+	"github.com/google/nftables"
 	"github.com/josexy/cropstun/common/buf"
 	"github.com/josexy/cropstun/common/bufio"
 	N "github.com/josexy/cropstun/common/network"
+	"github.com/josexy/cropstun/common/prefixset"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
 
 	"golang.org/x/sys/unix"
 )
@@ -20,30 +26,102 @@ var _ LinuxTUN = (*NativeTun)(nil)
 
 type NativeTun struct {
 	tunFd             int
+	queueFds          []int
 	tunFile           *os.File
+	queueFiles        []*os.File
 	tunWriter         N.VectorisedWriter
 	options           *Options
-	ruleIndex6        []int
 	txChecksumOffload bool
+	vnetHdr           bool
+	deviceAccess      sync.RWMutex
+	readAccess        sync.Mutex
+	readBuffer        []byte
+	readSegments      [][]byte
+	netNS             netns.NsHandle
+	nlHandle          *netlink.Handle
+	nftConn           *nftables.Conn
+	nftRuleset        *nftablesRuleset
+	state             *linuxState
+	previousSysctls   []Sysctl
+	addedRoutes       []Route
+	access            sync.Mutex
+	linkIndex         int
+	relink            func() error
+	monitorDone       chan struct{}
+	monitorClosed     chan struct{}
 }
 
 func New(options *Options) (Tun, error) {
+	if options.FileDescriptor != nil {
+		return NewFromFD(*options.FileDescriptor, options)
+	}
+	if options.StatePath != "" {
+		err := Cleanup(options.StatePath)
+		if err != nil {
+			return nil, err
+		}
+	}
 	var nativeTun *NativeTun
-	tunFd, err := open(options.Name)
+	var flags uint16
+	if options.GSO {
+		flags |= unix.IFF_VNET_HDR
+	}
+	ns, nlHandle, err := openNetNS(options.NetNS)
 	if err != nil {
 		return nil, err
 	}
-	tunLink, err := netlink.LinkByName(options.Name)
+	if options.Attach {
+		_, err = nlHandle.LinkByName(options.Name)
+		if err != nil {
+			closeNetNS(ns, nlHandle)
+			return nil, err
+		}
+	}
+	var tunFds []int
+	err = inNetNS(ns, func() (err error) {
+		tunFds, err = openQueues(options.Name, options.Queues, flags)
+		return
+	})
 	if err != nil {
+		closeNetNS(ns, nlHandle)
 		return nil, err
 	}
+	if !options.Attach {
+		err = setDeviceOwnership(tunFds[0], options)
+		if err != nil {
+			for _, fd := range tunFds {
+				unix.Close(fd)
+			}
+			closeNetNS(ns, nlHandle)
+			return nil, err
+		}
+	}
 	nativeTun = &NativeTun{
-		tunFd:   tunFd,
-		tunFile: os.NewFile(uintptr(tunFd), "tun"),
-		options: options,
+		tunFd:    tunFds[0],
+		queueFds: tunFds[1:],
+		tunFile:  os.NewFile(uintptr(tunFds[0]), "tun"),
+		options:  options,
+		vnetHdr:  options.GSO,
+		netNS:    ns,
+		nlHandle: nlHandle,
+	}
+	for _, fd := range nativeTun.queueFds {
+		nativeTun.queueFiles = append(nativeTun.queueFiles, os.NewFile(uintptr(fd), "tun"))
+	}
+	if options.StatePath != "" {
+		nativeTun.state = &linuxState{Name: options.Name, NetNS: options.NetNS}
+	}
+	tunLink, err := nlHandle.LinkByName(options.Name)
+	if err != nil {
+		nativeTun.closeFds()
+		return nil, err
 	}
 	err = nativeTun.configure(tunLink)
 	if err != nil {
+		if nativeTun.state != nil {
+			_ = nativeTun.undoState()
+		}
+		nativeTun.closeFds()
 		return nil, err
 	}
 	var ok bool
@@ -54,19 +132,174 @@ func New(options *Options) (Tun, error) {
 	return nativeTun, nil
 }
 
+// NewFromFD wraps an already opened tun file descriptor, for example one
+// inherited from a privileged helper or handed over by an Android VPN
+// service. The device is expected to be configured by its owner, so no
+// addresses, routes or rules are installed. options is copied, and may be
+// nil.
+func NewFromFD(fd int, options *Options) (Tun, error) {
+	name, flags, err := ifInfo(fd)
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		return nil, err
+	}
+	var tunOptions Options
+	if options != nil {
+		tunOptions = *options
+	}
+	tunOptions.Name = name
+	tunOptions.FileDescriptor = &fd
+	nativeTun := &NativeTun{
+		tunFd:    fd,
+		tunFile:  os.NewFile(uintptr(fd), "tun"),
+		options:  &tunOptions,
+		vnetHdr:  flags&unix.IFF_VNET_HDR != 0,
+		netNS:    netns.None(),
+		nlHandle: &netlink.Handle{},
+	}
+	var ok bool
+	nativeTun.tunWriter, ok = bufio.CreateVectorisedWriter(nativeTun.tunFile)
+	if !ok {
+		panic("create vectorised writer")
+	}
+	return nativeTun, nil
+}
+
+// Read reads a packet. With GSO, the kernel may send a TCP super-packet,
+// whose segments are returned by this and the following calls.
 func (t *NativeTun) Read(p []byte) (n int, err error) {
-	return t.tunFile.Read(p)
+	for {
+		file, _ := t.device()
+		n, err = t.readFile(file, p)
+		// a device reopened by MonitorLink closes the old file
+		if err == nil || t.tunFileIs(file) {
+			return n, err
+		}
+	}
+}
+
+// device returns the file of the first queue and its writer, which reopen
+// replaces while they may be in use.
+func (t *NativeTun) device() (*os.File, N.VectorisedWriter) {
+	t.deviceAccess.RLock()
+	defer t.deviceAccess.RUnlock()
+	return t.tunFile, t.tunWriter
+}
+
+func (t *NativeTun) tunFileIs(file *os.File) bool {
+	current, _ := t.device()
+	return current == file
+}
+
+func (t *NativeTun) readFile(file *os.File, p []byte) (n int, err error) {
+	if !t.vnetHdr {
+		return file.Read(p)
+	}
+	t.readAccess.Lock()
+	defer t.readAccess.Unlock()
+	if len(t.readSegments) > 0 {
+		n = copy(p, t.readSegments[0])
+		t.readSegments = t.readSegments[1:]
+		return n, nil
+	}
+	if t.readBuffer == nil {
+		t.readBuffer = make([]byte, maxGSOSize)
+	}
+	var hdr [virtioNetHdrLen]byte
+	for {
+		n, err = readVnet(file, hdr[:], t.readBuffer)
+		if err != nil {
+			return 0, err
+		}
+		first := true
+		err = vnetSegments(parseVnetHeader(hdr[:]), t.readBuffer[:n], func(segment []byte) bool {
+			if first {
+				n = copy(p, segment)
+				first = false
+			} else {
+				t.readSegments = append(t.readSegments, slices.Clone(segment))
+			}
+			return true
+		})
+		// malformed packets are dropped
+		if err == nil && !first {
+			return n, nil
+		}
+	}
+}
+
+// readVnet reads a packet preceded by a virtio_net_hdr into hdr and p, and
+// returns the length of the packet without the header.
+func readVnet(file *os.File, hdr, p []byte) (n int, err error) {
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var readErr error
+	err = rawConn.Read(func(fd uintptr) bool {
+		n, readErr = unix.Readv(int(fd), [][]byte{hdr, p})
+		return readErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = readErr
+	}
+	if n < len(hdr) {
+		return 0, err
+	}
+	return n - len(hdr), err
 }
 
 func (t *NativeTun) Write(p []byte) (n int, err error) {
-	return t.tunFile.Write(p)
+	if !t.vnetHdr {
+		file, _ := t.device()
+		return file.Write(p)
+	}
+	err = t.WriteVectorised([]*buf.Buffer{buf.As(p)})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
+// virtioNetHdr is an empty virtio_net_hdr, prepended to packets written by
+// WriteVectorised when the device was opened with IFF_VNET_HDR.
+var virtioNetHdr [virtioNetHdrLen]byte
+
 func (t *NativeTun) WriteVectorised(buffers []*buf.Buffer) error {
-	return t.tunWriter.WriteVectorised(buffers)
+	if t.vnetHdr {
+		buffers = append([]*buf.Buffer{buf.As(virtioNetHdr[:])}, buffers...)
+	}
+	_, writer := t.device()
+	return writer.WriteVectorised(buffers)
 }
 
-func open(name string) (int, error) {
+// openQueues opens queues file descriptors attached to the same device.
+// More than one queue requires IFF_MULTI_QUEUE on every descriptor.
+func openQueues(name string, queues int, flags uint16) ([]int, error) {
+	if queues <= 1 {
+		fd, err := open(name, flags)
+		if err != nil {
+			return nil, err
+		}
+		return []int{fd}, nil
+	}
+	fds := make([]int, 0, queues)
+	for i := 0; i < queues; i++ {
+		fd, err := open(name, flags|unix.IFF_MULTI_QUEUE)
+		if err != nil {
+			for _, fd := range fds {
+				unix.Close(fd)
+			}
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+func open(name string, flags uint16) (int, error) {
 	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR, 0)
 	if err != nil {
 		return -1, err
@@ -79,13 +312,20 @@ func open(name string) (int, error) {
 	}
 
 	copy(ifr.name[:], name)
-	ifr.flags = unix.IFF_TUN | unix.IFF_NO_PI
+	ifr.flags = unix.IFF_TUN | unix.IFF_NO_PI | flags
 	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
 	if errno != 0 {
 		unix.Close(fd)
 		return -1, errno
 	}
 
+	if flags&unix.IFF_VNET_HDR != 0 {
+		if err = setOffload(fd, tunOffloadFlags); err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
+	}
+
 	if err = unix.SetNonblock(fd, true); err != nil {
 		unix.Close(fd)
 		return -1, err
@@ -94,19 +334,97 @@ func open(name string) (int, error) {
 	return fd, nil
 }
 
+func ifInfo(fd int) (string, uint16, error) {
+	var ifr struct {
+		name  [16]byte
+		flags uint16
+		_     [22]byte
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNGETIFF, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return "", 0, os.NewSyscallError("TUNGETIFF", errno)
+	}
+	return unix.ByteSliceToString(ifr.name[:]), ifr.flags, nil
+}
+
 func (t *NativeTun) configure(tunLink netlink.Link) error {
-	err := netlink.LinkSetMTU(tunLink, int(t.options.MTU))
-	if err == unix.EPERM {
-		// unprivileged
+	if !t.options.Attach {
+		err := t.configureLink(tunLink)
+		if err != nil {
+			return err
+		}
+	} else if !t.options.AutoRoute {
+		// an attached device is already set up, and may be opened without
+		// the privilege needed for the table routes below
 		return nil
-	} else if err != nil {
+	}
+
+	err := t.allocate(true)
+	if err != nil {
 		return err
 	}
 
+	// the table is built first, as it may refuse the options
+	ruleset, err := t.nftablesRuleset()
+	if err != nil {
+		return err
+	}
+
+	// each step is undone along with the ones before it on failure
+	var undo rollback
+	undo.push(func() error {
+		return errors.Join(t.unsetRoute0(tunLink), t.unsetKillSwitch())
+	})
+	err = t.setRoute(tunLink)
+	if err != nil {
+		return undo.run(err)
+	}
+
+	undo.push(t.unsetRules)
+	err = t.setRules()
+	if err != nil {
+		return undo.run(err)
+	}
+
+	undo.push(t.restoreSysctls)
+	err = t.setSysctls()
+	if err != nil {
+		return undo.run(err)
+	}
+
+	undo.push(t.unsetNftables)
+	err = t.applyNftables(ruleset)
+	if err != nil {
+		return undo.run(err)
+	}
+
+	return nil
+}
+
+// configureLink sets the MTU, transmit queue length and addresses of the
+// device and brings it up.
+func (t *NativeTun) configureLink(tunLink netlink.Link) error {
+	err := t.nlHandle.LinkSetMTU(tunLink, int(t.options.MTU))
+	if err != nil {
+		return err
+	}
+	if t.options.TxQueueLen > 0 {
+		err = t.nlHandle.LinkSetTxQLen(tunLink, t.options.TxQueueLen)
+		if err != nil {
+			return err
+		}
+	}
+
 	if len(t.options.Inet4Address) > 0 {
 		for _, address := range t.options.Inet4Address {
+			err = t.journal(func(state *linuxState) {
+				state.Addresses = append(state.Addresses, address.String())
+			})
+			if err != nil {
+				return err
+			}
 			addr4, _ := netlink.ParseAddr(address.String())
-			err = netlink.AddrAdd(tunLink, addr4)
+			err = t.nlHandle.AddrAdd(tunLink, addr4)
 			if err != nil {
 				return err
 			}
@@ -114,61 +432,80 @@ func (t *NativeTun) configure(tunLink netlink.Link) error {
 	}
 	if len(t.options.Inet6Address) > 0 {
 		for _, address := range t.options.Inet6Address {
+			err = t.journal(func(state *linuxState) {
+				state.Addresses = append(state.Addresses, address.String())
+			})
+			if err != nil {
+				return err
+			}
 			addr6, _ := netlink.ParseAddr(address.String())
-			err = netlink.AddrAdd(tunLink, addr6)
+			err = t.nlHandle.AddrAdd(tunLink, addr6)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	var rxChecksumOffload bool
-	rxChecksumOffload, err = checkChecksumOffload(t.options.Name, unix.ETHTOOL_GRXCSUM)
-	if err == nil && !rxChecksumOffload {
-		_ = setChecksumOffload(t.options.Name, unix.ETHTOOL_SRXCSUM)
-	}
+	_ = inNetNS(t.netNS, func() error {
+		rxChecksumOffload, err := checkChecksumOffload(t.options.Name, unix.ETHTOOL_GRXCSUM)
+		if err == nil && !rxChecksumOffload {
+			_ = setChecksumOffload(t.options.Name, unix.ETHTOOL_SRXCSUM)
+		}
+		return nil
+	})
 
-	err = netlink.LinkSetUp(tunLink)
-	if err != nil {
-		return err
-	}
+	return t.nlHandle.LinkSetUp(tunLink)
+}
 
-	if t.options.IPRoute2TableIndex == 0 {
-		for {
-			t.options.IPRoute2TableIndex = int(rand.Uint32())
-			routeList, fErr := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: t.options.IPRoute2TableIndex}, netlink.RT_FILTER_TABLE)
-			if len(routeList) == 0 || fErr != nil {
-				break
-			}
+func (t *NativeTun) Close() (err error) {
+	// the device is deleted below and must not be recreated
+	t.stopMonitor()
+	// forwarding is turned off even when the kill switch keeps the rules
+	t.restoreSysctls()
+	if t.options.FileDescriptor == nil && !t.killSwitch() {
+		if t.state != nil {
+			t.undoState()
+		} else {
+			t.unsetRoute()
+			t.unsetAddedRoutes()
+			t.unsetRules()
+			t.unsetNftables()
 		}
 	}
-
-	err = t.setRoute(tunLink)
-	if err != nil {
-		_ = t.unsetRoute0(tunLink)
-		return err
+	if t.tunFile != nil {
+		err = t.closeFds()
 	}
+	return
+}
 
-	err = t.unsetRules()
-	if err != nil {
-		return err
+func (t *NativeTun) closeFds() error {
+	for _, file := range t.queueFiles {
+		file.Close()
 	}
-	err = t.setRules()
-	if err != nil {
-		_ = t.unsetRules()
-		return err
+	t.queueFds = nil
+	t.queueFiles = nil
+	t.closeNftables()
+	closeNetNS(t.netNS, t.nlHandle)
+	return t.tunFile.Close()
+}
+
+func closeNetNS(ns netns.NsHandle, nlHandle *netlink.Handle) {
+	nlHandle.Close()
+	if ns.IsOpen() {
+		ns.Close()
 	}
+}
 
-	return nil
+// files returns the files of all queues, starting with the one used by
+// Read and Write.
+func (t *NativeTun) files() []*os.File {
+	return append([]*os.File{t.tunFile}, t.queueFiles...)
 }
 
-func (t *NativeTun) Close() (err error) {
-	t.unsetRoute()
-	t.unsetRules()
-	if t.tunFile != nil {
-		err = t.tunFile.Close()
-	}
-	return
+// fds returns the file descriptors of all queues, starting with the one
+// used by Read and Write.
+func (t *NativeTun) fds() []int {
+	return append([]int{t.tunFd}, t.queueFds...)
 }
 
 func (t *NativeTun) TXChecksumOffload() bool {
@@ -198,27 +535,11 @@ func (t *NativeTun) routes(tunLink netlink.Link) ([]netlink.Route, error) {
 	return routes, nil
 }
 
-func (t *NativeTun) nextIndex6() int {
-	ruleList, err := netlink.RuleList(netlink.FAMILY_V6)
-	if err != nil {
-		return -1
-	}
-	var minIndex int
-	for _, rule := range ruleList {
-		if rule.Priority > 0 && (minIndex == 0 || rule.Priority < minIndex) {
-			minIndex = rule.Priority
-		}
-	}
-	minIndex--
-	t.ruleIndex6 = append(t.ruleIndex6, minIndex)
-	return minIndex
-}
-
 func (t *NativeTun) rules() []*netlink.Rule {
 	if !t.options.AutoRoute {
 		if len(t.options.Inet6Address) > 0 {
 			it := netlink.NewRule()
-			it.Priority = t.nextIndex6()
+			it.Priority = t.options.IPRoute2RuleIndex
 			it.Table = t.options.IPRoute2TableIndex
 			it.Family = unix.AF_INET6
 			it.OifName = t.options.Name
@@ -245,9 +566,47 @@ func (t *NativeTun) rules() []*netlink.Rule {
 
 	ruleStart := t.options.IPRoute2RuleIndex
 	priority := ruleStart
-	priority6 := priority
+	nopPriority := ruleStart + ruleBlockSize - 1
+
+	var families []int
+	if p4 {
+		families = append(families, unix.AF_INET)
+	}
+	if p6 {
+		families = append(families, unix.AF_INET6)
+	}
 
-	nopPriority := ruleStart + 10
+	// strict mode blocks IPv6 even without an IPv6 address on the tun, so
+	// marked sockets and excluded traffic must be let through for both
+	// families
+	markFamilies := families
+	if t.options.StrictRoute && !p6 {
+		markFamilies = append(markFamilies, unix.AF_INET6)
+	}
+
+	if t.options.OutboundMark != 0 {
+		for _, family := range markFamilies {
+			it = netlink.NewRule()
+			it.Priority = priority
+			it.Mark = t.options.OutboundMark
+			it.Table = unix.RT_TABLE_MAIN
+			it.Family = family
+			rules = append(rules, it)
+		}
+		priority++
+	}
+
+	// exclude selectors also apply to forwarded LAN clients
+	if t.hasSelectors() {
+		rules = append(rules, t.selectorRules(markFamilies, priority, nopPriority)...)
+		priority += 2
+	}
+
+	if len(t.options.GatewayInterface) > 0 {
+		rules = append(rules, t.gatewayRules(families, priority)...)
+		priority++
+	}
+	priority6 := priority
 
 	if p4 {
 		for _, address := range t.options.Inet4Address {
@@ -277,7 +636,7 @@ func (t *NativeTun) rules() []*netlink.Rule {
 		rules = append(rules, it)
 		priority6++
 	}
-	if p4 {
+	if p4 && !t.options.StrictRoute {
 		it = netlink.NewRule()
 		it.Priority = priority
 		it.Invert = true
@@ -288,7 +647,7 @@ func (t *NativeTun) rules() []*netlink.Rule {
 		rules = append(rules, it)
 	}
 
-	if p6 {
+	if p6 && !t.options.StrictRoute {
 		it = netlink.NewRule()
 		it.Priority = priority6
 		it.Invert = true
@@ -378,16 +737,129 @@ func (t *NativeTun) rules() []*netlink.Rule {
 		rules = append(rules, it)
 		priority6++
 	}
-	if p4 {
+	if t.options.StrictRoute {
+		rules = append(rules, t.strictRules(markFamilies, max(priority, priority6))...)
+	}
+	for _, family := range markFamilies {
 		it = netlink.NewRule()
 		it.Priority = nopPriority
-		it.Family = unix.AF_INET
+		it.Type = nl.FR_ACT_NOP
+		it.Family = family
 		rules = append(rules, it)
 	}
-	if p6 {
+	return rules
+}
+
+// strictRules sends RouteExcludeAddress to the main table at priority and
+// rejects the rest of the routed ranges of families at priority+1. A family
+// without RouteAddress prefixes is rejected entirely, so IPv6 is when the
+// tun has no IPv6 address, while destinations outside RouteAddress keep
+// using the main table.
+func (t *NativeTun) strictRules(families []int, priority int) []*netlink.Rule {
+	var rules []*netlink.Rule
+	for _, address := range t.options.RouteExcludeAddress {
+		family := unix.AF_INET
+		if address.Addr().Is6() {
+			family = unix.AF_INET6
+		}
+		if !slices.Contains(families, family) {
+			continue
+		}
+		it := netlink.NewRule()
+		it.Priority = priority
+		it.Dst = prefixToIPNet(address.Masked())
+		it.Table = unix.RT_TABLE_MAIN
+		it.Family = family
+		rules = append(rules, it)
+	}
+	routeAddress := prefixset.New(t.options.RouteAddress...)
+	for _, family := range families {
+		unspecified := netip.IPv4Unspecified()
+		if family == unix.AF_INET6 {
+			unspecified = netip.IPv6Unspecified()
+		}
+		for _, routeRange := range buildFamilyRanges(routeAddress, unspecified).Prefixes() {
+			it := netlink.NewRule()
+			it.Priority = priority + 1
+			it.Type = nl.FR_ACT_UNREACHABLE
+			if routeRange.Bits() > 0 {
+				it.Dst = prefixToIPNet(routeRange)
+			}
+			it.Family = family
+			rules = append(rules, it)
+		}
+	}
+	return rules
+}
+
+func (t *NativeTun) hasSelectors() bool {
+	return t.hasIncludeSelectors() ||
+		len(t.options.ExcludeUID) > 0 ||
+		len(t.options.ExcludeInterface) > 0 ||
+		len(t.options.ExcludeSource) > 0
+}
+
+func (t *NativeTun) hasIncludeSelectors() bool {
+	return len(t.options.IncludeUID) > 0 ||
+		len(t.options.IncludeInterface) > 0 ||
+		len(t.options.IncludeSource) > 0 ||
+		len(t.options.IncludeCgroup) > 0
+}
+
+// selectorRules narrows the auto-route rules that follow at priority+2 to
+// the selected traffic. Excluded traffic, and traffic matching no include
+// selector when there is one, jumps to nopPriority and bypasses the tun.
+func (t *NativeTun) selectorRules(families []int, priority, nopPriority int) []*netlink.Rule {
+	var rules []*netlink.Rule
+	// the gateway interfaces are included, so that their clients keep
+	// reaching the gateway rules
+	includeInterface := t.options.IncludeInterface
+	if t.hasIncludeSelectors() {
+		includeInterface = append(slices.Clone(includeInterface), t.options.GatewayInterface...)
+	}
+	for _, family := range families {
+		rules = append(rules, t.familySelectorRules(family, t.options.ExcludeUID, t.options.ExcludeInterface, t.options.ExcludeSource, priority, nopPriority)...)
+		rules = append(rules, t.familySelectorRules(family, t.options.IncludeUID, includeInterface, t.options.IncludeSource, priority, priority+2)...)
+		rules = append(rules, t.includeCgroupRules(family, priority)...)
+		if t.hasIncludeSelectors() {
+			it := netlink.NewRule()
+			it.Priority = priority + 1
+			it.Goto = nopPriority
+			it.Family = family
+			rules = append(rules, it)
+		}
+	}
+	return rules
+}
+
+func (t *NativeTun) familySelectorRules(family int, uidRanges []UIDRange, interfaces []string, sources []netip.Prefix, priority, target int) []*netlink.Rule {
+	var rules []*netlink.Rule
+	var it *netlink.Rule
+	for _, uidRange := range uidRanges {
 		it = netlink.NewRule()
-		it.Priority = nopPriority
-		it.Family = unix.AF_INET6
+		it.Priority = priority
+		it.UIDRange = netlink.NewRuleUIDRange(uidRange.Start, uidRange.End)
+		it.Goto = target
+		it.Family = family
+		rules = append(rules, it)
+	}
+	for _, name := range interfaces {
+		it = netlink.NewRule()
+		it.Priority = priority
+		it.IifName = name
+		it.Goto = target
+		it.Family = family
+		rules = append(rules, it)
+	}
+	for _, source := range sources {
+		if source.Addr().Is4() != (family == unix.AF_INET) {
+			continue
+		}
+		it = netlink.NewRule()
+		it.Priority = priority
+		it.Src = prefixToIPNet(source.Masked())
+		it.Goto = target
+		it.Family = family
 		rules = append(rules, it)
 	}
 	return rules
@@ -398,18 +870,37 @@ func (t *NativeTun) setRoute(tunLink netlink.Link) error {
 	if err != nil {
 		return err
 	}
+	err = t.journalRoutes(routes)
+	if err != nil {
+		return err
+	}
 	for _, route := range routes {
-		err := netlink.RouteAdd(&route)
+		err = t.nlHandle.RouteAdd(&route)
 		if err != nil {
 			return err
 		}
 	}
+	if t.killSwitch() {
+		return t.setKillSwitch()
+	}
 	return nil
 }
 
+func (t *NativeTun) killSwitch() bool {
+	return t.options.KillSwitch && t.options.AutoRoute
+}
+
 func (t *NativeTun) setRules() error {
-	for _, rule := range t.rules() {
-		err := netlink.RuleAdd(rule)
+	rules := t.rules()
+	for _, rule := range rules {
+		rule.Protocol = ruleProtocol
+	}
+	err := t.journalRules(rules)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		err = t.addRule(rule)
 		if err != nil {
 			return err
 		}
@@ -418,7 +909,7 @@ func (t *NativeTun) setRules() error {
 }
 
 func (t *NativeTun) unsetRoute() error {
-	tunLink, err := netlink.LinkByName(t.options.Name)
+	tunLink, err := t.nlHandle.LinkByName(t.options.Name)
 	if err != nil {
 		return err
 	}
@@ -428,44 +919,22 @@ func (t *NativeTun) unsetRoute() error {
 func (t *NativeTun) unsetRoute0(tunLink netlink.Link) error {
 	if routes, err := t.routes(tunLink); err == nil {
 		for _, route := range routes {
-			_ = netlink.RouteDel(&route)
+			_ = t.nlHandle.RouteDel(&route)
 		}
 	}
 	return nil
 }
 
 func (t *NativeTun) unsetRules() error {
-	if len(t.ruleIndex6) > 0 {
-		for _, index := range t.ruleIndex6 {
-			ruleToDel := netlink.NewRule()
-			ruleToDel.Family = unix.AF_INET6
-			ruleToDel.Priority = index
-			err := netlink.RuleDel(ruleToDel)
-			if err != nil {
-				return err
-			}
-		}
-		t.ruleIndex6 = nil
+	ruleList, err := t.ownRules(t.options.IPRoute2RuleIndex)
+	if err != nil {
+		return err
 	}
-
-	if t.options.AutoRoute {
-		ruleList, err := netlink.RuleList(netlink.FAMILY_ALL)
+	for _, rule := range ruleList {
+		err = t.deleteRule(rule)
 		if err != nil {
 			return err
 		}
-		for _, rule := range ruleList {
-			ruleStart := t.options.IPRoute2RuleIndex
-			ruleEnd := ruleStart + 10
-			if rule.Priority >= ruleStart && rule.Priority <= ruleEnd {
-				ruleToDel := netlink.NewRule()
-				ruleToDel.Family = rule.Family
-				ruleToDel.Priority = rule.Priority
-				err = netlink.RuleDel(ruleToDel)
-				if err != nil {
-					return err
-				}
-			}
-		}
 	}
 	return nil
 }
@@ -483,6 +952,24 @@ func (t *NativeTun) SetupDNS(addrs []netip.Addr) error {
 	if err != nil {
 		return err
 	}
+	err = t.journal(func(state *linuxState) {
+		state.DNS = true
+	})
+	if err != nil {
+		return err
+	}
+	commands := t.dnsCommands(addrs)
+	go func() {
+		for _, args := range commands {
+			_ = execCommandIn(t.netNS, ctlPath, args...)
+		}
+	}()
+	return nil
+}
+
+// dnsCommands returns the resolvectl arguments that make the tun the
+// default DNS route with addrs as servers.
+func (t *NativeTun) dnsCommands(addrs []netip.Addr) [][]string {
 	var dnsServerList []string
 	for _, dns := range addrs {
 		if !dns.IsValid() {
@@ -490,12 +977,11 @@ func (t *NativeTun) SetupDNS(addrs []netip.Addr) error {
 		}
 		dnsServerList = append(dnsServerList, dns.String())
 	}
-	go func() {
-		_ = execCommand(ctlPath, "domain", t.options.Name, "~.")
-		_ = execCommand(ctlPath, "default-route", t.options.Name, "true")
-		_ = execCommand(ctlPath, append([]string{"dns", t.options.Name}, dnsServerList...)...)
-	}()
-	return nil
+	return [][]string{
+		{"domain", t.options.Name, "~."},
+		{"default-route", t.options.Name, "true"},
+		append([]string{"dns", t.options.Name}, dnsServerList...),
+	}
 }
 
 func (t *NativeTun) TeardownDNS() error { return nil }
@@ -505,3 +991,11 @@ func execCommand(name string, args ...string) error {
 	command.Env = os.Environ()
 	return command.Run()
 }
+
+// execCommandIn runs a command in ns, where resolvectl resolves the name of
+// the tun to the index of the device.
+func execCommandIn(ns netns.NsHandle, name string, args ...string) error {
+	return inNetNS(ns, func() error {
+		return execCommand(name, args...)
+	})
+}
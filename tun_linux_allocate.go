@@ -0,0 +1,173 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ruleBlockSize is the number of rule priorities used by a tun, starting
+	// at IPRoute2RuleIndex.
+	ruleBlockSize = 11
+	// ruleProtocol tags the rules installed by a tun, which tells them apart
+	// from the rules of other software.
+	ruleProtocol = 207
+	// maxRulePriority keeps the rules ahead of the main table.
+	maxRulePriority = 32765
+)
+
+var (
+	ErrRuleConflict  = errors.New("rule priorities in use")
+	ErrTableConflict = errors.New("route table in use")
+)
+
+// allocate picks a free rule priority block and an unused route table for
+// the zero IPRoute2RuleIndex and IPRoute2TableIndex, and refuses explicit
+// ones that are used by foreign rules or by another tun. Rules and blocking
+// routes left behind by a tun of the same Name are removed if removeStale is
+// set.
+func (t *NativeTun) allocate(removeStale bool) error {
+	ruleList, err := t.nlHandle.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	if t.options.IPRoute2RuleIndex == 0 {
+		for start := DefaultIPRoute2RuleIndex; ; start += ruleBlockSize {
+			if start+ruleBlockSize-1 > maxRulePriority {
+				return fmt.Errorf("%w: no free block of %d priorities", ErrRuleConflict, ruleBlockSize)
+			}
+			if t.checkRuleBlock(ruleList, start) == nil {
+				t.options.IPRoute2RuleIndex = start
+				break
+			}
+		}
+	} else {
+		err = t.checkRuleBlock(ruleList, t.options.IPRoute2RuleIndex)
+		if err != nil {
+			return err
+		}
+	}
+	if t.options.IPRoute2TableIndex == 0 {
+		for table := DefaultIPRoute2TableIndex; ; table++ {
+			err = t.checkTable(ruleList, table)
+			if err == nil {
+				t.options.IPRoute2TableIndex = table
+				break
+			} else if !errors.Is(err, ErrTableConflict) {
+				return err
+			}
+		}
+	} else {
+		err = t.checkTable(ruleList, t.options.IPRoute2TableIndex)
+		if err != nil {
+			return err
+		}
+	}
+	if !removeStale {
+		return nil
+	}
+	// whatever is left in the block is ours and stale, and the table is
+	// referenced by no other rules
+	for _, rule := range ruleList {
+		if t.inRuleBlock(rule, t.options.IPRoute2RuleIndex) {
+			err = t.deleteRule(rule)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return t.unsetKillSwitch()
+}
+
+func (t *NativeTun) inRuleBlock(rule netlink.Rule, start int) bool {
+	return rule.Priority >= start && rule.Priority < start+ruleBlockSize
+}
+
+// checkRuleBlock fails if a priority of the block starting at start holds a
+// rule that is not tagged with ruleProtocol, or one that was not left behind
+// by a tun of the same Name. The rules of another tun are kept even if its
+// device is gone, since its kill switch may still be blocking its traffic.
+// With Attach, the device may also be routed by another running tun, so
+// even rules referencing it are not taken for stale ones.
+func (t *NativeTun) checkRuleBlock(ruleList []netlink.Rule, start int) error {
+	var used, owned bool
+	for _, rule := range ruleList {
+		if !t.inRuleBlock(rule, start) {
+			continue
+		}
+		if rule.Protocol != ruleProtocol {
+			return fmt.Errorf("%w: foreign rule at priority %d: %s", ErrRuleConflict, rule.Priority, rule)
+		}
+		used = true
+		for _, name := range []string{rule.IifName, rule.OifName} {
+			if name == "" || name == "lo" {
+				continue
+			}
+			if name != t.options.Name || t.options.Attach {
+				return fmt.Errorf("%w: priority %d is used by the tun %s", ErrRuleConflict, rule.Priority, name)
+			}
+			owned = true
+		}
+	}
+	if used && !owned {
+		return fmt.Errorf("%w: priorities from %d are used by another tun", ErrRuleConflict, start)
+	}
+	return nil
+}
+
+// checkTable fails if table holds routes other than stale blocking routes,
+// or is referenced by rules outside of the rule block of t.
+func (t *NativeTun) checkTable(ruleList []netlink.Rule, table int) error {
+	switch table {
+	case unix.RT_TABLE_UNSPEC, unix.RT_TABLE_COMPAT, unix.RT_TABLE_DEFAULT, unix.RT_TABLE_MAIN, unix.RT_TABLE_LOCAL:
+		return fmt.Errorf("%w: table %d is reserved", ErrTableConflict, table)
+	}
+	for _, rule := range ruleList {
+		if rule.Table != table {
+			continue
+		}
+		if rule.Protocol != ruleProtocol || !t.inRuleBlock(rule, t.options.IPRoute2RuleIndex) {
+			return fmt.Errorf("%w: table %d is referenced by rule %s", ErrTableConflict, table, rule)
+		}
+	}
+	routeList, err := t.nlHandle.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for _, route := range routeList {
+		if route.Type == unix.RTN_UNREACHABLE && route.Priority == killSwitchMetric {
+			continue
+		}
+		return fmt.Errorf("%w: table %d has route %s", ErrTableConflict, table, route)
+	}
+	return nil
+}
+
+func (t *NativeTun) ownRules(start int) ([]netlink.Rule, error) {
+	ruleList, err := t.nlHandle.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	var rules []netlink.Rule
+	for _, rule := range ruleList {
+		if rule.Protocol == ruleProtocol && t.inRuleBlock(rule, start) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// deleteRule deletes one rule with the priority and protocol of rule.
+func (t *NativeTun) deleteRule(rule netlink.Rule) error {
+	ruleToDel := netlink.NewRule()
+	ruleToDel.Family = rule.Family
+	ruleToDel.Priority = rule.Priority
+	ruleToDel.Protocol = rule.Protocol
+	return ignoreNotFound(t.nlHandle.RuleDel(ruleToDel))
+}
@@ -0,0 +1,127 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"golang.org/x/sys/unix"
+)
+
+func blockRule(priority int, iifName string, protocol uint8) netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Priority = priority
+	rule.IifName = iifName
+	rule.Table = DefaultIPRoute2TableIndex
+	rule.Protocol = protocol
+	rule.Family = unix.AF_INET
+	return *rule
+}
+
+func TestCheckRuleBlock(t *testing.T) {
+	start := DefaultIPRoute2RuleIndex
+	for _, test := range []struct {
+		name     string
+		rules    []netlink.Rule
+		attach   bool
+		conflict bool
+	}{
+		{"empty", nil, false, false},
+		{"outside", []netlink.Rule{blockRule(start-1, "tunA", 0), blockRule(start+ruleBlockSize, "tunA", ruleProtocol)}, false, false},
+		{"stale", []netlink.Rule{blockRule(start, "", ruleProtocol), blockRule(start+1, "tun0", ruleProtocol)}, false, false},
+		{"stale attached", []netlink.Rule{blockRule(start+1, "tun0", ruleProtocol)}, true, true},
+		{"foreign", []netlink.Rule{blockRule(start+2, "", 0)}, false, true},
+		{"other tun", []netlink.Rule{blockRule(start, "tun0", ruleProtocol), blockRule(start+1, "tunA", ruleProtocol)}, false, true},
+		{"unknown tun", []netlink.Rule{blockRule(start, "", ruleProtocol)}, false, true},
+	} {
+		tun := &NativeTun{options: &Options{Name: "tun0", Attach: test.attach}}
+		err := tun.checkRuleBlock(test.rules, start)
+		if test.conflict != errors.Is(err, ErrRuleConflict) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+// TestAllocate leaves the rules and kill switch of a crashed tun in a
+// namespace, and checks that another tun moves to the next free block and
+// table, while a tun of the same name reclaims them.
+func TestAllocate(t *testing.T) {
+	_, path := newTestNetNS(t)
+	ns, nlHandle, err := openNetNS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNetNS(ns, nlHandle)
+	for _, rule := range []netlink.Rule{
+		blockRule(DefaultIPRoute2RuleIndex, "tunA", ruleProtocol),
+		blockRule(DefaultIPRoute2RuleIndex+1, "", ruleProtocol),
+	} {
+		err = nlHandle.RuleAdd(&rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	killSwitch := &netlink.Route{
+		Dst:      prefixToIPNet(netip.MustParsePrefix("0.0.0.0/0")),
+		Type:     unix.RTN_UNREACHABLE,
+		Priority: killSwitchMetric,
+		Table:    DefaultIPRoute2TableIndex,
+	}
+	err = nlHandle.RouteAdd(killSwitch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTun := func(options Options) *NativeTun {
+		options.Inet4Address = []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")}
+		options.AutoRoute = true
+		return &NativeTun{options: &options, netNS: ns, nlHandle: nlHandle}
+	}
+	countLeftovers := func() (rules, routes int) {
+		ownRules, err := newTun(Options{}).ownRules(DefaultIPRoute2RuleIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routeList, err := nlHandle.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: DefaultIPRoute2TableIndex}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(ownRules), len(routeList)
+	}
+
+	tunB := newTun(Options{Name: "tunB"})
+	err = tunB.allocate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunB.options.IPRoute2RuleIndex != DefaultIPRoute2RuleIndex+ruleBlockSize || tunB.options.IPRoute2TableIndex != DefaultIPRoute2TableIndex+1 {
+		t.Errorf("allocated priority %d and table %d", tunB.options.IPRoute2RuleIndex, tunB.options.IPRoute2TableIndex)
+	}
+	if rules, routes := countLeftovers(); rules != 2 || routes != 1 {
+		t.Errorf("the kill switch of the crashed tun was removed, %d rules and %d routes left", rules, routes)
+	}
+
+	err = newTun(Options{Name: "tunB", IPRoute2RuleIndex: DefaultIPRoute2RuleIndex}).allocate(true)
+	if !errors.Is(err, ErrRuleConflict) {
+		t.Errorf("unexpected error %v for a used block", err)
+	}
+	err = newTun(Options{Name: "tunB", IPRoute2TableIndex: DefaultIPRoute2TableIndex}).allocate(true)
+	if !errors.Is(err, ErrTableConflict) {
+		t.Errorf("unexpected error %v for a used table", err)
+	}
+
+	tunA := newTun(Options{Name: "tunA"})
+	err = tunA.allocate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunA.options.IPRoute2RuleIndex != DefaultIPRoute2RuleIndex || tunA.options.IPRoute2TableIndex != DefaultIPRoute2TableIndex {
+		t.Errorf("reclaimed priority %d and table %d", tunA.options.IPRoute2RuleIndex, tunA.options.IPRoute2TableIndex)
+	}
+	if rules, routes := countLeftovers(); rules != 0 || routes != 0 {
+		t.Errorf("%d stale rules and %d routes left", rules, routes)
+	}
+}
@@ -0,0 +1,151 @@
+//go:build linux
+
+package tun
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoCgroup2 is returned for IncludeCgroup and ExcludeCgroup when no
+// cgroup v2 hierarchy is mounted.
+var ErrNoCgroup2 = errors.New("cgroup v2 is not mounted")
+
+// resolveCgroup returns the ID and the level of a cgroup, replaced by tests
+// running without cgroup v2.
+var resolveCgroup = cgroupID
+
+// includeCgroupMark is the firewall mark of the traffic of IncludeCgroup.
+// The route table index is unique among the tuns, and so is the default
+// mark.
+func (t *NativeTun) includeCgroupMark() uint32 {
+	if t.options.IncludeCgroupMark != 0 {
+		return t.options.IncludeCgroupMark
+	}
+	return uint32(t.options.IPRoute2TableIndex)
+}
+
+// includeCgroupRules sends the traffic of IncludeCgroup to the auto-route
+// table, except for destinations with a more specific route than the
+// default one in main, like the gateway rules. Its source was picked by
+// the route lookup made before the mark was set, so the auto-route rules
+// for local traffic do not apply.
+func (t *NativeTun) includeCgroupRules(family, priority int) []*netlink.Rule {
+	if len(t.options.IncludeCgroup) == 0 {
+		return nil
+	}
+	it := netlink.NewRule()
+	it.Priority = priority
+	it.Mark = t.includeCgroupMark()
+	it.Table = unix.RT_TABLE_MAIN
+	it.SuppressPrefixlen = 0
+	it.Family = family
+	rules := []*netlink.Rule{it}
+
+	it = netlink.NewRule()
+	it.Priority = priority
+	it.Mark = t.includeCgroupMark()
+	it.Table = t.options.IPRoute2TableIndex
+	it.Family = family
+	return append(rules, it)
+}
+
+// cgroupMatch matches the packets of the sockets created by the processes
+// of the cgroup v2 at cgroupPath, relative to the root of the hierarchy, or
+// of its descendants. The cgroup is resolved to its ID, so one created again
+// under the same path is not matched.
+func cgroupMatch(cgroupPath string) (nftablesRule, error) {
+	id, level, err := resolveCgroup(cgroupPath)
+	if err != nil {
+		return nftablesRule{}, err
+	}
+	return nftablesRule{
+		exprs: []expr.Any{
+			&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: level, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint64(id)},
+		},
+		text: fmt.Sprintf("socket cgroupv2 level %d %q", level, strings.Trim(path.Clean("/"+cgroupPath), "/")),
+	}, nil
+}
+
+// markMismatch matches the packets not carrying mark, such as those of the
+// sockets marked with OutboundMark by the handler.
+func markMismatch(mark uint32) nftablesRule {
+	return nftablesRule{
+		exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+		},
+		text: fmt.Sprintf("meta mark != 0x%x", mark),
+	}
+}
+
+// cgroupID returns the ID of the cgroup at cgroupPath and its level, the
+// depth below the root of the hierarchy. The mount point may itself be a
+// cgroup below the root, in a cgroup namespace or a container.
+func cgroupID(cgroupPath string) (id uint64, level uint32, err error) {
+	root, mountPoint, err := findCgroup2()
+	if err != nil {
+		return 0, 0, err
+	}
+	cgroupPath = path.Clean("/" + cgroupPath)
+	var stat unix.Stat_t
+	err = unix.Stat(filepath.Join(mountPoint, cgroupPath), &stat)
+	if err != nil {
+		return 0, 0, &os.PathError{Op: "stat", Path: cgroupPath, Err: err}
+	}
+	fullPath := strings.Trim(path.Join(root, cgroupPath), "/")
+	if fullPath != "" {
+		level = uint32(strings.Count(fullPath, "/") + 1)
+	}
+	return stat.Ino, level, nil
+}
+
+// findCgroup2 returns the root and the mount point of the first cgroup v2
+// mount, at /sys/fs/cgroup on unified systems and at
+// /sys/fs/cgroup/unified on hybrid ones.
+func findCgroup2() (root, mountPoint string, err error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 42 32 0:38 / /sys/fs/cgroup/unified rw,relatime - cgroup2 cgroup2 rw
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 5 || separator+1 >= len(fields) || fields[separator+1] != "cgroup2" {
+			continue
+		}
+		return unescapeMountInfo(fields[3]), unescapeMountInfo(fields[4]), nil
+	}
+	err = scanner.Err()
+	if err != nil {
+		return "", "", err
+	}
+	return "", "", ErrNoCgroup2
+}
+
+// unescapeMountInfo decodes the octal escapes of the spaces, tabs,
+// newlines and backslashes in a path of mountinfo.
+func unescapeMountInfo(field string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(field)
+}
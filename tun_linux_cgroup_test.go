@@ -0,0 +1,77 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestCgroupRules(t *testing.T) {
+	resolveCgroup = func(string) (uint64, uint32, error) {
+		return 1234, 2, nil
+	}
+	defer func() {
+		resolveCgroup = cgroupID
+	}()
+	tun := testTun(Options{
+		IncludeCgroup: []string{"system.slice/nginx.service"},
+		ExcludeCgroup: []string{"system.slice/nginx.service"},
+	})
+	_, err := tun.nftablesRuleset()
+	if !errors.Is(err, ErrOutboundMarkRequired) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tun.options.OutboundMark = 0x10
+	assertEqualCommands(t, ruleCommands(tun.rules()),
+		"ip rule add priority 10086 fwmark 0x10 lookup main",
+		"ip rule add priority 10087 fwmark 0xfa0 lookup main suppress_prefixlength 0",
+		"ip rule add priority 10087 fwmark 0xfa0 lookup 4000",
+		"ip rule add priority 10088 goto 10096",
+		"ip rule add priority 10089 to 198.18.0.0/16 lookup 4000",
+		"ip rule add priority 10090 lookup 4000 suppress_prefixlength 0",
+		"ip rule add not priority 10091 dport 53-53 lookup main suppress_prefixlength 0",
+		"ip rule add priority 10091 iif tun0 goto 10096",
+		"ip rule add not priority 10092 iif lo lookup 4000",
+		"ip rule add priority 10092 from 0.0.0.0/32 iif lo lookup 4000",
+		"ip rule add priority 10092 from 198.18.0.0/16 iif lo lookup 4000",
+		"ip rule add priority 10096 nop",
+	)
+	ruleset, err := tun.nftablesRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the exclusion is matched before the inclusion
+	assertEqualCommands(t, ruleset.commands(),
+		"add table inet cropstun_tun0",
+		"add chain inet cropstun_tun0 output '{ type route hook output priority mangle; }'",
+		`add rule inet cropstun_tun0 output socket cgroupv2 level 2 "system.slice/nginx.service" meta mark set 0x10`,
+		`add rule inet cropstun_tun0 output meta mark != 0x10 socket cgroupv2 level 2 "system.slice/nginx.service" meta mark set 0xfa0`,
+		"add chain inet cropstun_tun0 postrouting '{ type nat hook postrouting priority srcnat; }'",
+		`add rule inet cropstun_tun0 postrouting ip saddr 198.18.0.1 oifname != "tun0" masquerade`,
+	)
+	// the replies to the rerouted sockets pass the reverse path filter
+	if sysctls := tun.sysctls(); !slices.Equal(sysctls, []Sysctl{{Key: "net.ipv4.conf.tun0.rp_filter", Value: "2"}}) {
+		t.Errorf("unexpected sysctls %v", sysctls)
+	}
+
+	tun = testTun(Options{
+		IncludeCgroup:     []string{"system.slice/nginx.service"},
+		IncludeCgroupMark: 0x20,
+		OutboundMark:      0x10,
+	})
+	assertCommands(t, ruleCommands(tun.rules()),
+		"ip rule add priority 10087 fwmark 0x20 lookup main suppress_prefixlength 0",
+		"ip rule add priority 10087 fwmark 0x20 lookup 4000",
+	)
+	ruleset, err = tun.nftablesRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualCommands(t, ruleset.commands(),
+		"add table inet cropstun_tun0",
+		"add chain inet cropstun_tun0 output '{ type route hook output priority mangle; }'",
+		`add rule inet cropstun_tun0 output meta mark != 0x10 socket cgroupv2 level 2 "system.slice/nginx.service" meta mark set 0x20`,
+	)
+}
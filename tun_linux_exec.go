@@ -0,0 +1,127 @@
+//go:build linux
+
+package tun
+
+import (
+	"net/netip"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+var defaultExecAddress = netip.MustParsePrefix("198.18.0.1/16")
+
+// Exec runs cmd in a new network namespace whose only way out is a tun
+// device served by a gVisor stack in the calling process, and waits for cmd
+// to exit. Connections made by handler originate from the caller's
+// namespace, so the host routing table is left untouched.
+//
+// Routes are installed in the main table of the new namespace, AutoRoute is
+// ignored. If options has no address, 198.18.0.1/16 is used. Note that a
+// resolver on loopback, such as systemd-resolved, is not reachable from the
+// new namespace.
+func Exec(cmd *exec.Cmd, options *Options, handler Handler) error {
+	tunOptions := *options
+	if tunOptions.Name == "" {
+		tunOptions.Name = "tun0"
+	}
+	if tunOptions.MTU == 0 {
+		tunOptions.MTU = DefaultMTU
+	}
+	if len(tunOptions.Inet4Address) == 0 && len(tunOptions.Inet6Address) == 0 {
+		tunOptions.Inet4Address = []netip.Prefix{defaultExecAddress}
+	}
+	tunOptions.AutoRoute = false
+
+	ns, err := newNetNS()
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	tunOptions.NetNS = "/proc/self/fd/" + strconv.Itoa(int(ns))
+
+	tunDevice, err := New(&tunOptions)
+	if err != nil {
+		return err
+	}
+	nativeTun := tunDevice.(*NativeTun)
+	if err = nativeTun.setExecRoutes(); err != nil {
+		tunDevice.Close()
+		return err
+	}
+	tunStack, err := NewStack(StackOptions{
+		Tun:        tunDevice,
+		TunOptions: &tunOptions,
+		Handler:    handler,
+	})
+	if err != nil {
+		tunDevice.Close()
+		return err
+	}
+	if err = tunStack.Start(); err != nil {
+		tunDevice.Close()
+		return err
+	}
+	defer tunStack.Close()
+
+	// the child inherits the network namespace of the thread that forks it
+	err = inNetNS(ns, cmd.Start)
+	if err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// newNetNS creates an anonymous network namespace, which lives as long as
+// the returned handle is open, without moving the caller into it.
+func newNetNS() (netns.NsHandle, error) {
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return netns.None(), err
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return netns.None(), err
+	}
+	if err = netns.Set(origin); err != nil {
+		ns.Close()
+		return netns.None(), err
+	}
+	runtime.UnlockOSThread()
+	return ns, nil
+}
+
+func (t *NativeTun) setExecRoutes() error {
+	loLink, err := t.nlHandle.LinkByName("lo")
+	if err != nil {
+		return err
+	}
+	if err = t.nlHandle.LinkSetUp(loLink); err != nil {
+		return err
+	}
+	tunLink, err := t.nlHandle.LinkByName(t.options.Name)
+	if err != nil {
+		return err
+	}
+	routeRanges, err := t.options.BuildAutoRouteRanges()
+	if err != nil {
+		return err
+	}
+	for _, routeRange := range routeRanges {
+		err = t.nlHandle.RouteAdd(&netlink.Route{
+			Dst:       prefixToIPNet(routeRange),
+			LinkIndex: tunLink.Attrs().Index,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
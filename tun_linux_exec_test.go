@@ -0,0 +1,40 @@
+//go:build linux
+
+package tun
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExec(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	ipPath, err := exec.LookPath("ip")
+	if err != nil {
+		t.Skip("ip is not installed")
+	}
+	var output bytes.Buffer
+	cmd := exec.Command(ipPath, "route")
+	cmd.Stdout = &output
+	err = Exec(cmd, &Options{}, &udpEchoHandler{metadata: make(chan Metadata, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if !slices.ContainsFunc(routes, func(route string) bool {
+		return strings.HasPrefix(route, "default dev tun0")
+	}) {
+		t.Errorf("no default route through the tun in:\n%s", output.String())
+	}
+	for _, route := range routes {
+		if !strings.Contains(route, " dev tun0") {
+			t.Errorf("route %q does not go through the tun", route)
+		}
+	}
+}
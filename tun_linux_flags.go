@@ -56,3 +56,21 @@ func setChecksumOffload(name string, cmd uint32) error {
 	}
 	return nil
 }
+
+const (
+	virtioNetHdrLen = 10
+
+	tunFCsum = 0x01 // TUN_F_CSUM
+	tunFTSO4 = 0x02 // TUN_F_TSO4
+	tunFTSO6 = 0x04 // TUN_F_TSO6
+
+	tunOffloadFlags = tunFCsum | tunFTSO4 | tunFTSO6
+)
+
+func setOffload(fd int, flags uint32) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETOFFLOAD, uintptr(flags))
+	if errno != 0 {
+		return os.NewSyscallError("TUNSETOFFLOAD", errno)
+	}
+	return nil
+}
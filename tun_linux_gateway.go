@@ -0,0 +1,174 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"golang.org/x/sys/unix"
+)
+
+// gatewayRules sends the traffic arriving on the gateway interfaces to the
+// auto-route table, except for destinations with a more specific route than
+// the default one in main, such as the LAN itself. Addresses of the host
+// are matched earlier by the local table.
+func (t *NativeTun) gatewayRules(families []int, priority int) []*netlink.Rule {
+	var rules []*netlink.Rule
+	for _, family := range families {
+		for _, name := range t.options.GatewayInterface {
+			it := netlink.NewRule()
+			it.Priority = priority
+			it.IifName = name
+			it.Table = unix.RT_TABLE_MAIN
+			it.SuppressPrefixlen = 0
+			it.Family = family
+			rules = append(rules, it)
+
+			it = netlink.NewRule()
+			it.Priority = priority
+			it.IifName = name
+			it.Table = t.options.IPRoute2TableIndex
+			it.Family = family
+			rules = append(rules, it)
+		}
+	}
+	return rules
+}
+
+// sysctls returns the kernel parameters needed by the options.
+func (t *NativeTun) sysctls() []Sysctl {
+	if !t.options.AutoRoute {
+		return nil
+	}
+	gateway := len(t.options.GatewayInterface) > 0
+	var sysctls []Sysctl
+	if len(t.options.Inet4Address) > 0 {
+		if gateway {
+			sysctls = append(sysctls, Sysctl{Key: "net.ipv4.ip_forward", Value: "1"})
+		}
+		// replies to LAN clients, and to the sockets of IncludeCgroup
+		// rerouted after picking the address of another interface, come in
+		// through the tun from addresses routed through main, which strict
+		// reverse path filtering drops
+		if gateway || len(t.options.IncludeCgroup) > 0 {
+			sysctls = append(sysctls, Sysctl{Key: "net.ipv4.conf." + sysctlName(t.options.Name) + ".rp_filter", Value: "2"})
+		}
+	}
+	if len(t.options.Inet6Address) > 0 && gateway {
+		sysctls = append(sysctls, Sysctl{Key: "net.ipv6.conf.all.forwarding", Value: "1"})
+	}
+	if t.options.ReturnInbound {
+		// accepted TCP sockets take the mark of their SYN, so that even
+		// their first route lookup goes through main
+		sysctls = append(sysctls, Sysctl{Key: "net.ipv4.tcp_fwmark_accept", Value: "1"})
+	}
+	return sysctls
+}
+
+// setSysctls applies the kernel parameters of the options, recording the
+// previous values for restoreSysctls. Parameters recorded by an earlier call,
+// such as those of a recreated device, are applied again.
+func (t *NativeTun) setSysctls() error {
+	return inNetNS(t.netNS, func() error {
+		for _, sysctl := range t.sysctls() {
+			if slices.ContainsFunc(t.previousSysctls, func(it Sysctl) bool {
+				return it.Key == sysctl.Key
+			}) {
+				err := writeSysctl(sysctl.Key, sysctl.Value)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			value, err := readSysctl(sysctl.Key)
+			if err != nil {
+				return err
+			}
+			if value == sysctl.Value {
+				continue
+			}
+			previous := Sysctl{Key: sysctl.Key, Value: value}
+			err = t.journal(func(state *linuxState) {
+				state.Sysctls = append(state.Sysctls, previous)
+			})
+			if err != nil {
+				return err
+			}
+			t.previousSysctls = append(t.previousSysctls, previous)
+			err = writeSysctl(sysctl.Key, sysctl.Value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// restoreSysctls sets the kernel parameters changed by setSysctls back to
+// their previous values.
+func (t *NativeTun) restoreSysctls() error {
+	if len(t.previousSysctls) == 0 {
+		return nil
+	}
+	err := restoreSysctls(t.netNS, t.previousSysctls)
+	if err != nil {
+		return err
+	}
+	t.previousSysctls = nil
+	return t.journal(func(state *linuxState) {
+		state.Sysctls = nil
+	})
+}
+
+func restoreSysctls(ns netns.NsHandle, sysctls []Sysctl) error {
+	return inNetNS(ns, func() error {
+		var errs []error
+		for i := len(sysctls) - 1; i >= 0; i-- {
+			err := writeSysctl(sysctls[i].Key, sysctls[i].Value)
+			// the settings of a deleted device are gone with it
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// sysctlName escapes the dots of an interface name, such as that of a VLAN
+// device, for use as a component of a sysctl key.
+func sysctlName(name string) string {
+	return strings.ReplaceAll(name, ".", "/")
+}
+
+// sysctlPath maps a key such as net.ipv4.conf.eth0/100.rp_filter to its
+// file under /proc/sys, where the roles of dots and slashes are swapped.
+func sysctlPath(key string) string {
+	return "/proc/sys/" + strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		default:
+			return r
+		}
+	}, key)
+}
+
+func readSysctl(key string) (string, error) {
+	content, err := os.ReadFile(sysctlPath(key))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func writeSysctl(key, value string) error {
+	return os.WriteFile(sysctlPath(key), []byte(value), 0o644)
+}
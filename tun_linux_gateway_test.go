@@ -0,0 +1,92 @@
+//go:build linux
+
+package tun
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSysctls(t *testing.T) {
+	ns, _ := newTestNetNS(t)
+	tun := &NativeTun{
+		options: &Options{
+			Name:             "lo",
+			Inet4Address:     []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")},
+			AutoRoute:        true,
+			GatewayInterface: []string{"eth0"},
+		},
+		netNS: ns,
+	}
+	values := func() (forward, rpFilter string) {
+		err := inNetNS(ns, func() (err error) {
+			forward, err = readSysctl("net.ipv4.ip_forward")
+			if err != nil {
+				return
+			}
+			rpFilter, err = readSysctl("net.ipv4.conf.lo.rp_filter")
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	forward, rpFilter := values()
+	err := tun.setSysctls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forward, rpFilter := values(); forward != "1" || rpFilter != "2" {
+		t.Errorf("unexpected ip_forward %s or rp_filter %s", forward, rpFilter)
+	}
+	err = tun.restoreSysctls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newForward, newRPFilter := values(); newForward != forward || newRPFilter != rpFilter {
+		t.Errorf("restored ip_forward %s and rp_filter %s, expected %s and %s", newForward, newRPFilter, forward, rpFilter)
+	}
+}
+
+func TestGatewayRules(t *testing.T) {
+	tun := testTun(Options{GatewayInterface: []string{"eth1.100"}})
+	assertEqualCommands(t, ruleCommands(tun.rules()),
+		"ip rule add priority 10086 iif eth1.100 lookup main suppress_prefixlength 0",
+		"ip rule add priority 10086 iif eth1.100 lookup 4000",
+		"ip rule add priority 10087 to 198.18.0.0/16 lookup 4000",
+		"ip rule add priority 10088 lookup 4000 suppress_prefixlength 0",
+		"ip rule add not priority 10089 dport 53-53 lookup main suppress_prefixlength 0",
+		"ip rule add priority 10089 iif tun0 goto 10096",
+		"ip rule add not priority 10090 iif lo lookup 4000",
+		"ip rule add priority 10090 from 0.0.0.0/32 iif lo lookup 4000",
+		"ip rule add priority 10090 from 198.18.0.0/16 iif lo lookup 4000",
+		"ip rule add priority 10096 nop",
+	)
+	expected := []Sysctl{
+		{Key: "net.ipv4.ip_forward", Value: "1"},
+		{Key: "net.ipv4.conf.tun0.rp_filter", Value: "2"},
+	}
+	if sysctls := tun.sysctls(); !slices.Equal(sysctls, expected) {
+		t.Errorf("unexpected sysctls %v", sysctls)
+	}
+	if path := sysctlPath("net.ipv4.conf.eth1/100.rp_filter"); path != "/proc/sys/net/ipv4/conf/eth1.100/rp_filter" {
+		t.Errorf("unexpected sysctl path %s", path)
+	}
+}
+
+func TestGatewayRulesAfterSelectors(t *testing.T) {
+	tun := testTun(Options{
+		GatewayInterface: []string{"eth1"},
+		IncludeUID:       []UIDRange{{Start: 1000, End: 1000}},
+		ExcludeSource:    []netip.Prefix{netip.MustParsePrefix("192.168.1.10/32")},
+	})
+	assertCommands(t, ruleCommands(tun.rules()),
+		"ip rule add priority 10086 from 192.168.1.10/32 goto 10096",
+		"ip rule add priority 10086 iif eth1 goto 10088",
+		"ip rule add priority 10087 goto 10096",
+		"ip rule add priority 10088 iif eth1 lookup main suppress_prefixlength 0",
+		"ip rule add priority 10088 iif eth1 lookup 4000",
+	)
+}
@@ -3,17 +3,255 @@
 package tun
 
 import (
+	"encoding/binary"
+	"os"
+	"runtime"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"golang.org/x/sys/unix"
 )
 
-var _ GVisorTun = (*NativeTun)(nil)
+var (
+	_ GVisorTun = (*NativeTun)(nil)
+	_ relinkTun = (*NativeTun)(nil)
+)
 
 func (t *NativeTun) NewEndpoint() (stack.LinkEndpoint, error) {
+	// the default of fdbased: a tun is only read with readv, so there is no
+	// dispatch mode whose throughput depends on the kernel
+	dispatchers := t.options.Dispatchers
+	if dispatchers <= 0 {
+		dispatchers = max(1, runtime.GOMAXPROCS(0)/len(t.fds()))
+	}
+	if t.vnetHdr {
+		gsoMaxSize := t.options.GSOMaxSize
+		if gsoMaxSize == 0 || gsoMaxSize > maxGSOSize {
+			gsoMaxSize = maxGSOSize
+		}
+		return &VnetEndpoint{
+			GenericEndpoint: NewGenericEndpoint(t, t.options.MTU),
+			files:           t.files(),
+			dispatchers:     dispatchers,
+			gsoMaxSize:      gsoMaxSize,
+		}, nil
+	}
 	return fdbased.New(&fdbased.Options{
-		FDs:               []int{t.tunFd},
-		MTU:               t.options.MTU,
-		RXChecksumOffload: true,
-		TXChecksumOffload: t.txChecksumOffload,
+		FDs:                  t.fds(),
+		MTU:                  t.options.MTU,
+		RXChecksumOffload:    true,
+		TXChecksumOffload:    t.txChecksumOffload,
+		ProcessorsPerChannel: dispatchers,
+	})
+}
+
+// setRelinkHandler makes MonitorLink pass the endpoint of a reopened device
+// to handler.
+func (t *NativeTun) setRelinkHandler(handler func(stack.LinkEndpoint)) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.relink = func() error {
+		endpoint, err := t.NewEndpoint()
+		if err != nil {
+			return err
+		}
+		handler(endpoint)
+		return nil
+	}
+}
+
+var (
+	_ stack.LinkEndpoint = (*VnetEndpoint)(nil)
+	_ stack.GSOEndpoint  = (*VnetEndpoint)(nil)
+)
+
+// VnetEndpoint is the link endpoint of a tun device opened with
+// IFF_VNET_HDR. fdbased only honours the virtio header on socket fds, so
+// the header is handled here: offloaded packets read from the kernel are
+// checksummed and segmented by vnetSegments, and the TCP segments of
+// netstack are written as GSO super-packets, which takes the place of GRO
+// on the way to the kernel.
+type VnetEndpoint struct {
+	*GenericEndpoint
+	files       []*os.File
+	dispatchers int
+	gsoMaxSize  uint32
+}
+
+// vnetProcessorQueueLen is the number of packets queued for each processor
+// of a VnetEndpoint.
+const vnetProcessorQueueLen = 256
+
+func (e *VnetEndpoint) GSOMaxSize() uint32 {
+	return e.gsoMaxSize
+}
+
+func (e *VnetEndpoint) SupportedGSO() stack.SupportedGSO {
+	return stack.HostGSOSupported
+}
+
+func (e *VnetEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.attach(dispatcher, func() {
+		for _, file := range e.files {
+			_ = file.SetReadDeadline(time.Time{})
+			var processors []chan *stack.PacketBuffer
+			if e.dispatchers > 1 {
+				processors = make([]chan *stack.PacketBuffer, e.dispatchers)
+				for i := range processors {
+					processors[i] = make(chan *stack.PacketBuffer, vnetProcessorQueueLen)
+					e.spawn(func() {
+						e.processLoop(processors[i])
+					})
+				}
+			}
+			e.spawn(func() {
+				e.dispatchLoop(file, processors)
+			})
+		}
+	})
+	if dispatcher == nil {
+		// wake the pending reads so that Wait returns before the files are
+		// closed, as the old endpoint is detached on relink
+		for _, file := range e.files {
+			_ = file.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// dispatchLoop reads the packets of file, and delivers them itself or, like
+// the processors of fdbased, hands them to processors by connection so that
+// the packets of a connection stay in order.
+func (e *VnetEndpoint) dispatchLoop(file *os.File, processors []chan *stack.PacketBuffer) {
+	defer func() {
+		for _, processor := range processors {
+			close(processor)
+		}
+	}()
+	hdr := make([]byte, virtioNetHdrLen)
+	packetBuffer := make([]byte, maxGSOSize)
+	for {
+		n, err := readVnet(file, hdr, packetBuffer)
+		if err != nil {
+			break
+		}
+		attached := true
+		// malformed packets are dropped
+		_ = vnetSegments(parseVnetHeader(hdr), packetBuffer[:n], func(segment []byte) bool {
+			if len(processors) == 0 {
+				attached = e.deliverPacket(segment)
+				return attached
+			}
+			attached = e.IsAttached()
+			if !attached {
+				return false
+			}
+			pkt := newPacketBuffer(segment)
+			if pkt != nil {
+				processors[flowHash(segment)%uint32(len(processors))] <- pkt
+			}
+			return true
+		})
+		if !attached {
+			return
+		}
+	}
+}
+
+func (e *VnetEndpoint) processLoop(packets chan *stack.PacketBuffer) {
+	for pkt := range packets {
+		// packets queued before a detach are dropped
+		e.deliver(pkt)
+		pkt.DecRef()
+	}
+}
+
+// flowHash hashes the addresses, and the ports of TCP and UDP, of an IP
+// packet with FNV-1a.
+func flowHash(packet []byte) uint32 {
+	var addresses, ports []byte
+	var protocol uint8
+	var headerLen int
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		if len(packet) < header.IPv4MinimumSize {
+			return 0
+		}
+		ip := header.IPv4(packet)
+		addresses = packet[12:20]
+		protocol = ip.Protocol()
+		headerLen = int(ip.HeaderLength())
+		if ip.FragmentOffset() != 0 {
+			protocol = 0
+		}
+	case header.IPv6Version:
+		if len(packet) < header.IPv6MinimumSize {
+			return 0
+		}
+		addresses = packet[8:40]
+		protocol = header.IPv6(packet).NextHeader()
+		headerLen = header.IPv6MinimumSize
+	default:
+		return 0
+	}
+	if (protocol == uint8(header.TCPProtocolNumber) || protocol == uint8(header.UDPProtocolNumber)) && len(packet) >= headerLen+4 {
+		ports = packet[headerLen : headerLen+4]
+	}
+	hash := uint32(2166136261)
+	for _, part := range [][]byte{addresses, ports} {
+		for _, b := range part {
+			hash ^= uint32(b)
+			hash *= 16777619
+		}
+	}
+	return hash
+}
+
+func (e *VnetEndpoint) WritePackets(packetBufferList stack.PacketBufferList) (int, tcpip.Error) {
+	var n int
+	for _, packet := range packetBufferList.AsSlice() {
+		var hdr [virtioNetHdrLen]byte
+		if packet.GSOOptions.Type != stack.GSONone {
+			binary.LittleEndian.PutUint16(hdr[2:], uint16(packet.HeaderSize()))
+			if packet.GSOOptions.NeedsCsum {
+				hdr[0] = virtioNetHdrFNeedsCsum
+				binary.LittleEndian.PutUint16(hdr[6:], packet.GSOOptions.L3HdrLen)
+				binary.LittleEndian.PutUint16(hdr[8:], packet.GSOOptions.CsumOffset)
+			}
+			if packet.Data().Size() > int(packet.GSOOptions.MSS) {
+				switch packet.GSOOptions.Type {
+				case stack.GSOTCPv4:
+					hdr[1] = virtioNetHdrGSOTCPv4
+				case stack.GSOTCPv6:
+					hdr[1] = virtioNetHdrGSOTCPv6
+				}
+				binary.LittleEndian.PutUint16(hdr[4:], packet.GSOOptions.MSS)
+			}
+		}
+		err := writeVnet(e.files[packet.Hash%uint32(len(e.files))], append([][]byte{hdr[:]}, packet.AsSlices()...))
+		if err != nil {
+			return n, &tcpip.ErrAborted{}
+		}
+		n++
+	}
+	return n, nil
+}
+
+func writeVnet(file *os.File, iovs [][]byte) error {
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var writeErr error
+	err = rawConn.Write(func(fd uintptr) bool {
+		_, writeErr = unix.Writev(int(fd), iovs)
+		return writeErr != unix.EAGAIN
 	})
+	if err == nil {
+		err = writeErr
+	}
+	return err
 }
@@ -0,0 +1,137 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrKillSwitchIndex is returned by ReleaseKillSwitch without the rule index
+// and route table of the tun. Those picked by New are in its Options.
+var ErrKillSwitchIndex = errors.New("IPRoute2RuleIndex and IPRoute2TableIndex are required")
+
+// killSwitchMetric ranks the blocking routes behind the routes of the tun
+// device, so that they only match once the device is gone.
+const killSwitchMetric = 1<<31 - 1
+
+// killSwitchRoutes returns an unreachable route for each auto-route range.
+// They live in the auto-route table next to the tun routes and outlive the
+// device, so the rules left in place by Close or a crash keep sending the
+// tunnelled traffic into them instead of falling through to main.
+func (t *NativeTun) killSwitchRoutes() ([]netlink.Route, error) {
+	routeRanges, err := t.options.BuildAutoRouteRanges()
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]netlink.Route, 0, len(routeRanges))
+	for _, r := range routeRanges {
+		routes = append(routes, netlink.Route{
+			Dst:      prefixToIPNet(r),
+			Type:     unix.RTN_UNREACHABLE,
+			Priority: killSwitchMetric,
+			Table:    t.options.IPRoute2TableIndex,
+		})
+	}
+	return routes, nil
+}
+
+func (t *NativeTun) setKillSwitch() error {
+	routes, err := t.killSwitchRoutes()
+	if err != nil {
+		return err
+	}
+	err = t.journalRoutes(routes)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		err = t.nlHandle.RouteReplace(&route)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *NativeTun) unsetKillSwitch() error {
+	routeList, err := t.nlHandle.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		Table: t.options.IPRoute2TableIndex,
+		Type:  unix.RTN_UNREACHABLE,
+	}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_TYPE)
+	if err != nil {
+		return err
+	}
+	for _, route := range routeList {
+		if route.Priority != killSwitchMetric {
+			continue
+		}
+		err = t.nlHandle.RouteDel(&route)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseKillSwitch removes the rules, blocking routes and nftables table
+// that a tun created with KillSwitch leaves behind after Close or a crash,
+// restoring normal routing. options must carry the same Name, NetNS,
+// IPRoute2TableIndex and IPRoute2RuleIndex as the tun, the indices being
+// required since zero ones may have been allocated to another tun. The
+// same can be done by hand with `ip rule del priority N` for each rule of
+// the rule index range, `ip route flush table T type unreachable` and
+// `nft delete table inet cropstun_<Name>`.
+//
+// The device must be gone, unless options has Persist, and the rules must
+// look up the route table of options, so that the rules of a running tun
+// are left alone.
+//
+// If options has a StatePath, the journal is replayed by Cleanup instead.
+func ReleaseKillSwitch(options *Options) error {
+	if options.StatePath != "" {
+		return Cleanup(options.StatePath)
+	}
+	if options.IPRoute2TableIndex <= 0 || options.IPRoute2RuleIndex <= 0 {
+		return ErrKillSwitchIndex
+	}
+	ns, nlHandle, err := openNetNS(options.NetNS)
+	if err != nil {
+		return err
+	}
+	defer closeNetNS(ns, nlHandle)
+	if !options.Persist {
+		if _, err = nlHandle.LinkByName(options.Name); err == nil {
+			return fmt.Errorf("%w: the tun %s still exists", ErrRuleConflict, options.Name)
+		}
+	}
+	tunOptions := *options
+	tunOptions.AutoRoute = true
+	t := &NativeTun{
+		options:  &tunOptions,
+		netNS:    ns,
+		nlHandle: nlHandle,
+	}
+	ruleList, err := t.ownRules(tunOptions.IPRoute2RuleIndex)
+	if err != nil {
+		return err
+	}
+	for _, rule := range ruleList {
+		if rule.Table > 0 && rule.Table != unix.RT_TABLE_MAIN && rule.Table != tunOptions.IPRoute2TableIndex {
+			return fmt.Errorf("%w: priority %d looks up table %d", ErrRuleConflict, rule.Priority, rule.Table)
+		}
+	}
+	err = t.unsetRules()
+	if err != nil {
+		return err
+	}
+	err = t.unsetKillSwitch()
+	if err != nil {
+		return err
+	}
+	return deleteNftables(ns, nftablesTableName(options.Name))
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestKillSwitchRoutes(t *testing.T) {
+	tun := testTun(Options{
+		Inet4Address: []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")},
+		Inet6Address: []netip.Prefix{netip.MustParsePrefix("fdfe:dcba:9876::1/126")},
+		KillSwitch:   true,
+	})
+	routes, err := tun.routes(&netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "tun0", Index: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	killSwitchRoutes, err := tun.killSwitchRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := &Plan{Name: "tun0"}
+	var commands []string
+	for _, route := range append(routes, killSwitchRoutes...) {
+		commands = append(commands, plan.routeCommand(route))
+	}
+	// the unreachable routes only match once the device routes are gone
+	assertEqualCommands(t, commands,
+		"ip route add 0.0.0.0/0 dev tun0 table 4000",
+		"ip route add ::/0 dev tun0 table 4000",
+		"ip route add unreachable 0.0.0.0/0 metric 2147483647 table 4000",
+		"ip route add unreachable ::/0 metric 2147483647 table 4000",
+	)
+
+	err = ReleaseKillSwitch(&Options{Name: "tun0"})
+	if !errors.Is(err, ErrKillSwitchIndex) {
+		t.Errorf("unexpected error %v without the indices", err)
+	}
+}
@@ -0,0 +1,306 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/josexy/cropstun/common/bufio"
+	"github.com/vishvananda/netlink"
+
+	"golang.org/x/sys/unix"
+)
+
+// LinkState is a change of the tun device reported by MonitorLink.
+type LinkState int
+
+const (
+	// LinkStateDown means the device was set down.
+	LinkStateDown LinkState = iota + 1
+	// LinkStateRemoved means the device was deleted.
+	LinkStateRemoved
+	// LinkStateRestored means the device is up again, with its addresses,
+	// routes and rules, and attached to the running stack.
+	LinkStateRestored
+	// LinkStateFailed means the device could not be restored. The monitor
+	// retries on the next change of the device.
+	LinkStateFailed
+)
+
+func (s LinkState) String() string {
+	switch s {
+	case LinkStateDown:
+		return "down"
+	case LinkStateRemoved:
+		return "removed"
+	case LinkStateRestored:
+		return "restored"
+	case LinkStateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// ErrMonitorAdopted is returned by MonitorLink for a device adopted with
+	// Options.FileDescriptor, which cannot be recreated.
+	ErrMonitorAdopted = errors.New("cannot monitor an adopted tun device")
+	// ErrMonitorRunning is returned by MonitorLink when the device is
+	// already monitored.
+	ErrMonitorRunning = errors.New("tun device is already monitored")
+)
+
+// MonitorLink watches the device until Close. A device that is set down is
+// brought back up and its addresses and routes are restored. A deleted
+// device is recreated with the same Options, or with Attach reopened once
+// it exists again, and the new device is attached to the running gVisor
+// stack in place of the old one. callback, if not nil, is called from the
+// monitor goroutine for every change. With Options.NetNS, MonitorLink must
+// be called before DropPrivileges. A device is monitored at most once.
+func (t *NativeTun) MonitorLink(callback func(state LinkState, err error)) error {
+	if t.options.FileDescriptor != nil {
+		return ErrMonitorAdopted
+	}
+	if callback == nil {
+		callback = func(LinkState, error) {}
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.monitorDone != nil {
+		return ErrMonitorRunning
+	}
+	tunLink, err := t.nlHandle.LinkByName(t.options.Name)
+	if err != nil {
+		return err
+	}
+	t.linkIndex = tunLink.Attrs().Index
+	done := make(chan struct{})
+	updates := make(chan netlink.LinkUpdate, 16)
+	options := netlink.LinkSubscribeOptions{
+		ErrorCallback: func(err error) {
+			select {
+			case <-done:
+			default:
+				callback(LinkStateFailed, err)
+			}
+		},
+	}
+	if t.netNS.IsOpen() {
+		options.Namespace = &t.netNS
+	}
+	err = netlink.LinkSubscribeWithOptions(updates, done, options)
+	if err != nil {
+		return err
+	}
+	closed := make(chan struct{})
+	t.monitorDone = done
+	t.monitorClosed = closed
+	go func() {
+		defer close(closed)
+		var removed bool
+		for {
+			select {
+			case <-done:
+				return
+			case update, ok := <-updates:
+				if !ok {
+					return
+				}
+				if update.Attrs().Name != t.options.Name {
+					continue
+				}
+				states, err := t.checkLink(&removed)
+				for _, state := range states {
+					if state == LinkStateFailed {
+						callback(state, err)
+					} else {
+						callback(state, nil)
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// checkLink compares the device with the one the tun is attached to and
+// restores it if needed, returning the changes to report. Updates are only
+// used as a trigger, so stale ones and those caused by the restoration
+// itself are harmless.
+func (t *NativeTun) checkLink(removed *bool) (states []LinkState, err error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	tunLink, err := t.nlHandle.LinkByName(t.options.Name)
+	var linkNotFound netlink.LinkNotFoundError
+	switch {
+	case errors.As(err, &linkNotFound):
+		if !*removed {
+			*removed = true
+			states = append(states, LinkStateRemoved)
+		}
+		if t.options.Attach {
+			// wait for the owner to create the device again
+			return states, nil
+		}
+		err = t.reopen()
+	case err != nil:
+	case tunLink.Attrs().Index != t.linkIndex:
+		if !*removed {
+			*removed = true
+			states = append(states, LinkStateRemoved)
+		}
+		err = t.reopen()
+	case tunLink.Attrs().Flags&net.FlagUp == 0:
+		states = append(states, LinkStateDown)
+		err = t.restoreLink(tunLink)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return append(states, LinkStateFailed), err
+	}
+	*removed = false
+	return append(states, LinkStateRestored), nil
+}
+
+// restoreLink brings a device that was set down back up, with the
+// addresses and routes the kernel dropped with it. The rules do not depend
+// on the state of the device and are kept.
+func (t *NativeTun) restoreLink(tunLink netlink.Link) error {
+	err := t.nlHandle.LinkSetUp(tunLink)
+	if err != nil {
+		return err
+	}
+	if !t.options.Attach {
+		for _, address := range append(slices.Clone(t.options.Inet4Address), t.options.Inet6Address...) {
+			addr, err := netlink.ParseAddr(address.String())
+			if err != nil {
+				return err
+			}
+			err = t.nlHandle.AddrReplace(tunLink, addr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !t.options.AutoRoute {
+		return nil
+	}
+	routes, err := t.routes(tunLink)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		err = t.nlHandle.RouteReplace(&route)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reopen opens the device again, creating and configuring it unless
+// Attach, and moves the tun and the stack to the new file descriptors.
+func (t *NativeTun) reopen() error {
+	var flags uint16
+	if t.vnetHdr {
+		flags |= unix.IFF_VNET_HDR
+	}
+	var tunFds []int
+	err := inNetNS(t.netNS, func() (err error) {
+		tunFds, err = openQueues(t.options.Name, t.options.Queues, flags)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	closeTunFds := func() {
+		for _, fd := range tunFds {
+			unix.Close(fd)
+		}
+	}
+	if !t.options.Attach {
+		err = setDeviceOwnership(tunFds[0], t.options)
+		if err != nil {
+			closeTunFds()
+			return err
+		}
+	}
+	tunLink, err := t.nlHandle.LinkByName(t.options.Name)
+	if err != nil {
+		closeTunFds()
+		return err
+	}
+	// the addresses and routes of the old device are gone with it
+	err = t.journal(func(state *linuxState) {
+		state.Routes = slices.DeleteFunc(state.Routes, func(it stateRoute) bool {
+			return it.Link != ""
+		})
+		if !t.options.Attach {
+			state.Addresses = nil
+		}
+	})
+	if err != nil {
+		closeTunFds()
+		return err
+	}
+	if !t.options.Attach {
+		err = t.configureLink(tunLink)
+	}
+	if err == nil && t.options.AutoRoute {
+		err = t.setRoute(tunLink)
+	}
+	if err == nil {
+		var undo rollback
+		err = t.addRoutes(extraRoutes(tunLink, t.addedRoutes), &undo)
+	}
+	if err == nil {
+		err = t.setSysctls()
+	}
+	if err != nil {
+		closeTunFds()
+		return err
+	}
+
+	oldFiles := t.files()
+	t.deviceAccess.Lock()
+	t.tunFd = tunFds[0]
+	t.queueFds = tunFds[1:]
+	t.tunFile = os.NewFile(uintptr(tunFds[0]), "tun")
+	t.queueFiles = nil
+	for _, fd := range t.queueFds {
+		t.queueFiles = append(t.queueFiles, os.NewFile(uintptr(fd), "tun"))
+	}
+	var ok bool
+	t.tunWriter, ok = bufio.CreateVectorisedWriter(t.tunFile)
+	t.deviceAccess.Unlock()
+	if !ok {
+		panic("create vectorised writer")
+	}
+	t.linkIndex = tunLink.Attrs().Index
+	if t.relink != nil {
+		// the endpoint of the old device is detached before its file
+		// descriptors are closed and their numbers reused
+		err = t.relink()
+	}
+	for _, file := range oldFiles {
+		file.Close()
+	}
+	return err
+}
+
+func (t *NativeTun) stopMonitor() {
+	t.access.Lock()
+	done, closed := t.monitorDone, t.monitorClosed
+	t.monitorDone = nil
+	t.access.Unlock()
+	if done == nil {
+		return
+	}
+	close(done)
+	<-closed
+}
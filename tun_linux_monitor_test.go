@@ -0,0 +1,108 @@
+//go:build linux
+
+package tun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestMonitorLink(t *testing.T) {
+	_, path := newTestNetNS(t)
+	tun, err := New(&Options{
+		Name:         "tun8",
+		MTU:          1500,
+		NetNS:        path,
+		Inet4Address: []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")},
+		AutoRoute:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	nativeTun := tun.(*NativeTun)
+	nlHandle := nativeTun.nlHandle
+	states := make(chan LinkState, 16)
+	err = nativeTun.MonitorLink(func(state LinkState, err error) {
+		if err != nil {
+			t.Log(err)
+		}
+		states <- state
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStates := func(expected ...LinkState) {
+		t.Helper()
+		for _, state := range expected {
+			select {
+			case got := <-states:
+				if got != state {
+					t.Fatalf("unexpected state %s, expected %s", got, state)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s state", state)
+			}
+		}
+	}
+	assertLink := func() netlink.Link {
+		t.Helper()
+		link, err := nlHandle.LinkByName("tun8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			t.Error("device is down")
+		}
+		addrs, err := nlHandle.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0].IPNet.String() != "198.18.0.1/16" {
+			t.Errorf("unexpected addresses %v", addrs)
+		}
+		routes, err := nlHandle.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Table:     DefaultIPRoute2TableIndex,
+		}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(routes) == 0 {
+			t.Error("the routes of the device are missing")
+		}
+		rules, err := nlHandle.RuleList(netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !containsRuleProtocol(rules) {
+			t.Error("the rules are missing")
+		}
+		return link
+	}
+	link := assertLink()
+
+	err = nlHandle.LinkSetDown(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStates(LinkStateDown, LinkStateRestored)
+	assertLink()
+
+	err = nlHandle.LinkDel(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStates(LinkStateRemoved, LinkStateRestored)
+	newLink := assertLink()
+	if newLink.Attrs().Index == link.Attrs().Index {
+		t.Error("device was not recreated")
+	}
+	if nativeTun.linkIndex != newLink.Attrs().Index {
+		t.Error("tun is not attached to the new device")
+	}
+}
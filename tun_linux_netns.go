@@ -0,0 +1,57 @@
+//go:build linux
+
+package tun
+
+import (
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// openNetNS opens the network namespace at path, which may also be a file
+// descriptor in the form /proc/self/fd/N. An empty path selects the
+// namespace of the caller.
+func openNetNS(path string) (netns.NsHandle, *netlink.Handle, error) {
+	if path == "" {
+		return netns.None(), &netlink.Handle{}, nil
+	}
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return netns.None(), nil, err
+	}
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		ns.Close()
+		return netns.None(), nil, err
+	}
+	return ns, handle, nil
+}
+
+// inNetNS runs fn on a thread switched into ns. Anything created by fn that
+// is bound to a namespace on creation, such as a tun device or a socket,
+// belongs to ns.
+func inNetNS(ns netns.NsHandle, fn func() error) error {
+	if !ns.IsOpen() {
+		return fn()
+	}
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	if err = netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	fnErr := fn()
+	if err = netns.Set(origin); err != nil {
+		// leave the thread locked so that the runtime terminates it
+		// instead of reusing it in the wrong namespace
+		return err
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package tun
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netns"
+)
+
+func TestNetNS(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	ns, err := newNetNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	assertNetNS(t, origin)
+
+	path := "/proc/self/fd/" + strconv.Itoa(int(ns))
+	opened, nlHandle, err := openNetNS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNetNS(opened, nlHandle)
+	links, err := nlHandle.LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Attrs().Name != "lo" {
+		t.Errorf("unexpected links %v in a new namespace", links)
+	}
+
+	// commands such as resolvectl run in the namespace of the tun
+	nsLink, err := os.Readlink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var childNS string
+	err = inNetNS(ns, func() error {
+		childOutput, err := exec.Command("readlink", "/proc/self/ns/net").Output()
+		childNS = string(childOutput)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(childNS) != nsLink {
+		t.Errorf("command ran in %s, expected %s", childNS, nsLink)
+	}
+	assertNetNS(t, origin)
+
+	_, _, err = openNetNS("/nonexistent")
+	if !os.IsNotExist(err) {
+		t.Errorf("unexpected error %v for a missing namespace", err)
+	}
+}
+
+func assertNetNS(t *testing.T, expected netns.NsHandle) {
+	t.Helper()
+	current, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+	if !current.Equal(expected) {
+		t.Error("the caller was moved to another namespace")
+	}
+}
@@ -0,0 +1,481 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netns"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrOutboundMarkRequired is returned for options whose nftables rules mark
+// the traffic that bypasses the tun, when OutboundMark is not set.
+var ErrOutboundMarkRequired = errors.New("OutboundMark is required")
+
+// nftablesTablePrefix starts the name of the private table of a tun. The
+// table holds everything the tun installs in nftables, so removing it is
+// the whole cleanup.
+const nftablesTablePrefix = "cropstun_"
+
+func nftablesTableName(name string) string {
+	return nftablesTablePrefix + name
+}
+
+// nftablesRuleset is the content of the private table, along with its nft
+// syntax for Plan.
+type nftablesRuleset struct {
+	table  *nftables.Table
+	sets   []nftablesSet
+	chains []nftablesChain
+}
+
+type nftablesSet struct {
+	set      *nftables.Set
+	spec     string
+	elements []nftables.SetElement
+	// values is the nft syntax of elements
+	values []string
+}
+
+type nftablesChain struct {
+	chain *nftables.Chain
+	spec  string
+	rules []nftablesRule
+}
+
+type nftablesRule struct {
+	exprs []expr.Any
+	text  string
+}
+
+// nftablesRuleset returns the table needed by the options, or nil if they
+// need none.
+func (t *NativeTun) nftablesRuleset() (*nftablesRuleset, error) {
+	if !t.options.AutoRoute || !t.hasNftables() {
+		return nil, nil
+	}
+	if t.options.OutboundMark == 0 {
+		switch {
+		case len(t.options.ExcludePort) > 0:
+			return nil, fmt.Errorf("%w by ExcludePort", ErrOutboundMarkRequired)
+		case len(t.options.ExcludeCgroup) > 0:
+			return nil, fmt.Errorf("%w by ExcludeCgroup", ErrOutboundMarkRequired)
+		case t.options.ReturnInbound:
+			return nil, fmt.Errorf("%w by ReturnInbound", ErrOutboundMarkRequired)
+		}
+	}
+	if len(t.options.IncludeCgroup) > 0 && t.options.OutboundMark == t.includeCgroupMark() {
+		return nil, fmt.Errorf("OutboundMark 0x%x is the mark of IncludeCgroup", t.options.OutboundMark)
+	}
+	ruleset := &nftablesRuleset{
+		table: &nftables.Table{
+			Family: nftables.TableFamilyINet,
+			Name:   nftablesTableName(t.options.Name),
+		},
+	}
+	// the fwmark rule of OutboundMark then sends the marked traffic
+	// through main, and a route chain reroutes local traffic once marked
+	var rules, preroutingRules []nftablesRule
+	if t.options.ReturnInbound {
+		rules = append(rules, ctMarkMatch(t.options.OutboundMark).then(markStatement(t.options.OutboundMark)))
+		preroutingRules = append(preroutingRules, t.returnInboundRule())
+	}
+	if len(t.options.ExcludePort) > 0 {
+		excludePort := ruleset.portSet("exclude_port", t.options.ExcludePort)
+		for _, protocol := range []string{"tcp", "udp"} {
+			rule := dportMatch(protocol, excludePort).then(markStatement(t.options.OutboundMark))
+			rules = append(rules, rule)
+			if len(t.options.GatewayInterface) > 0 {
+				preroutingRules = append(preroutingRules, rule)
+			}
+		}
+	}
+	for _, cgroupPath := range t.options.ExcludeCgroup {
+		match, err := cgroupMatch(cgroupPath)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, match.then(markStatement(t.options.OutboundMark)))
+	}
+	for _, cgroupPath := range t.options.IncludeCgroup {
+		match, err := cgroupMatch(cgroupPath)
+		if err != nil {
+			return nil, err
+		}
+		// excluded traffic is already marked
+		if t.options.OutboundMark != 0 {
+			match = markMismatch(t.options.OutboundMark).then(match)
+		}
+		rules = append(rules, match.then(markStatement(t.includeCgroupMark())))
+	}
+	ruleset.addChain(&nftables.Chain{
+		Name:     "output",
+		Type:     nftables.ChainTypeRoute,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityMangle,
+	}, "type route hook output priority mangle", rules)
+	if len(preroutingRules) > 0 {
+		ruleset.addChain(&nftables.Chain{
+			Name:     "prerouting",
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityMangle,
+		}, "type filter hook prerouting priority mangle", preroutingRules)
+	}
+	// included and returned traffic keeps its source, only the excluded
+	// one is rerouted away from the tun
+	if len(t.options.ExcludePort) > 0 || len(t.options.ExcludeCgroup) > 0 {
+		ruleset.addChain(&nftables.Chain{
+			Name:     "postrouting",
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookPostrouting,
+			Priority: nftables.ChainPriorityNATSource,
+		}, "type nat hook postrouting priority srcnat", t.masqueradeRules())
+	}
+	return ruleset, nil
+}
+
+// returnInboundRule marks with OutboundMark the connections accepted by the
+// host from another interface than the tun, so that the fwmark rule sends
+// their replies through main, back the way the connection came. Accepted
+// TCP sockets take the mark of their first packet, the replies of other
+// connections get it from conntrack in the output chain.
+func (t *NativeTun) returnInboundRule() nftablesRule {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, t.options.Name)
+	return nftablesRule{
+		exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: data},
+			&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitNEW),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+			&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(t.options.OutboundMark)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+		},
+		text: fmt.Sprintf("iifname != %q ct state new fib daddr type local meta mark set 0x%x ct mark set meta mark", t.options.Name, t.options.OutboundMark),
+	}
+}
+
+// ctMarkMatch matches the packets of the connections carrying mark in
+// conntrack.
+func ctMarkMatch(mark uint32) nftablesRule {
+	return nftablesRule{
+		exprs: []expr.Any{
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+		},
+		text: fmt.Sprintf("ct mark 0x%x", mark),
+	}
+}
+
+// masqueradeRules rewrites the source of the local traffic rerouted away
+// from the tun by the output chain, which keeps the tun address picked by
+// the first route lookup.
+func (t *NativeTun) masqueradeRules() []nftablesRule {
+	var rules []nftablesRule
+	for _, address := range append(slices.Clone(t.options.Inet4Address), t.options.Inet6Address...) {
+		rules = append(rules, saddrMatch(address.Addr()).
+			then(oifnameMismatch(t.options.Name)).
+			then(nftablesRule{exprs: []expr.Any{&expr.Masq{}}, text: "masquerade"}))
+	}
+	return rules
+}
+
+func (t *NativeTun) hasNftables() bool {
+	return t.options.ReturnInbound ||
+		len(t.options.ExcludePort) > 0 ||
+		len(t.options.IncludeCgroup) > 0 ||
+		len(t.options.ExcludeCgroup) > 0
+}
+
+// portSet adds an interval set of the merged port ranges.
+func (r *nftablesRuleset) portSet(name string, portRanges []PortRange) *nftables.Set {
+	set := &nftables.Set{
+		Table:    r.table,
+		Name:     name,
+		KeyType:  nftables.TypeInetService,
+		Interval: true,
+	}
+	var elements []nftables.SetElement
+	var values []string
+	for _, portRange := range mergePortRanges(portRanges) {
+		elements = append(elements, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(portRange.Start)})
+		// an interval is closed by the element following its end, so one
+		// reaching the last port is left open
+		if portRange.End < 65535 {
+			elements = append(elements, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(portRange.End + 1), IntervalEnd: true})
+		}
+		if portRange.Start == portRange.End {
+			values = append(values, fmt.Sprint(portRange.Start))
+		} else {
+			values = append(values, fmt.Sprintf("%d-%d", portRange.Start, portRange.End))
+		}
+	}
+	r.sets = append(r.sets, nftablesSet{
+		set:      set,
+		spec:     "type inet_service; flags interval;",
+		elements: elements,
+		values:   values,
+	})
+	return set
+}
+
+func (r *nftablesRuleset) addChain(chain *nftables.Chain, spec string, rules []nftablesRule) {
+	chain.Table = r.table
+	r.chains = append(r.chains, nftablesChain{chain: chain, spec: spec, rules: rules})
+}
+
+// mergePortRanges sorts portRanges and merges those that overlap or touch,
+// which an interval set refuses.
+func mergePortRanges(portRanges []PortRange) []PortRange {
+	portRanges = slices.Clone(portRanges)
+	for i, portRange := range portRanges {
+		if portRange.End < portRange.Start {
+			portRanges[i].End = portRange.Start
+		}
+	}
+	slices.SortFunc(portRanges, func(a, b PortRange) int {
+		return int(a.Start) - int(b.Start)
+	})
+	var merged []PortRange
+	for _, portRange := range portRanges {
+		if n := len(merged); n > 0 && int(portRange.Start) <= int(merged[n-1].End)+1 {
+			merged[n-1].End = max(merged[n-1].End, portRange.End)
+			continue
+		}
+		merged = append(merged, portRange)
+	}
+	return merged
+}
+
+// dportMatch matches the packets of protocol, tcp or udp, whose destination
+// port is in set.
+func dportMatch(protocol string, set *nftables.Set) nftablesRule {
+	l4proto := byte(unix.IPPROTO_TCP)
+	if protocol == "udp" {
+		l4proto = unix.IPPROTO_UDP
+	}
+	return nftablesRule{
+		exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			// the set is added in the same transaction and found by name
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name},
+		},
+		text: fmt.Sprintf("meta l4proto %s th dport @%s", protocol, set.Name),
+	}
+}
+
+// saddrMatch matches the packets from addr.
+func saddrMatch(addr netip.Addr) nftablesRule {
+	nfproto, offset, family := byte(unix.NFPROTO_IPV4), uint32(12), "ip"
+	if addr.Is6() {
+		nfproto, offset, family = unix.NFPROTO_IPV6, 8, "ip6"
+	}
+	return nftablesRule{
+		exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(addr.BitLen() / 8)},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr.AsSlice()},
+		},
+		text: fmt.Sprintf("%s saddr %s", family, addr),
+	}
+}
+
+// oifnameMismatch matches the packets leaving through another interface
+// than name.
+func oifnameMismatch(name string) nftablesRule {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return nftablesRule{
+		exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: data},
+		},
+		text: fmt.Sprintf("oifname != %q", name),
+	}
+}
+
+// markStatement sets the firewall mark of the packets.
+func markStatement(mark uint32) nftablesRule {
+	return nftablesRule{
+		exprs: []expr.Any{
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		},
+		text: fmt.Sprintf("meta mark set 0x%x", mark),
+	}
+}
+
+// then appends next to the rule.
+func (r nftablesRule) then(next nftablesRule) nftablesRule {
+	return nftablesRule{
+		exprs: append(slices.Clone(r.exprs), next.exprs...),
+		text:  r.text + " " + next.text,
+	}
+}
+
+// apply replaces the table with the ruleset in a single transaction, so
+// that a table left behind by a crash never mixes with the new one and a
+// failure leaves nothing behind.
+func (r *nftablesRuleset) apply(conn *nftables.Conn) error {
+	conn.AddTable(r.table)
+	conn.DelTable(r.table)
+	conn.AddTable(r.table)
+	for _, set := range r.sets {
+		err := conn.AddSet(set.set, set.elements)
+		if err != nil {
+			return err
+		}
+	}
+	for _, chain := range r.chains {
+		conn.AddChain(chain.chain)
+		for _, rule := range chain.rules {
+			conn.AddRule(&nftables.Rule{
+				Table: r.table,
+				Chain: chain.chain,
+				Exprs: rule.exprs,
+			})
+		}
+	}
+	return conn.Flush()
+}
+
+// commands renders the ruleset as the equivalent nft arguments.
+func (r *nftablesRuleset) commands() []string {
+	if r == nil {
+		return nil
+	}
+	table := "inet " + r.table.Name
+	commands := []string{"add table " + table}
+	for _, set := range r.sets {
+		commands = append(commands, fmt.Sprintf("add set %s %s '{ %s }'", table, set.set.Name, set.spec))
+		if len(set.values) > 0 {
+			commands = append(commands, fmt.Sprintf("add element %s %s '{ %s }'", table, set.set.Name, strings.Join(set.values, ", ")))
+		}
+	}
+	for _, chain := range r.chains {
+		commands = append(commands, fmt.Sprintf("add chain %s %s '{ %s; }'", table, chain.chain.Name, chain.spec))
+		for _, rule := range chain.rules {
+			commands = append(commands, fmt.Sprintf("add rule %s %s %s", table, chain.chain.Name, rule.text))
+		}
+	}
+	return commands
+}
+
+// newNftablesConn returns an nftables connection to ns. A lasting one keeps
+// its socket, opened in ns, for the lifetime of the tun.
+func newNftablesConn(ns netns.NsHandle, lasting bool) (*nftables.Conn, error) {
+	var options []nftables.ConnOption
+	if ns.IsOpen() {
+		options = append(options, nftables.WithNetNSFd(int(ns)))
+	}
+	if lasting {
+		options = append(options, nftables.AsLasting())
+	}
+	return nftables.New(options...)
+}
+
+// applyNftables replaces the private table with ruleset, or removes it if
+// ruleset is nil.
+func (t *NativeTun) applyNftables(ruleset *nftablesRuleset) error {
+	if ruleset == nil {
+		return t.unsetNftables()
+	}
+	err := t.journal(func(state *linuxState) {
+		state.Nftables = ruleset.table.Name
+	})
+	if err != nil {
+		return err
+	}
+	if t.nftConn == nil {
+		t.nftConn, err = newNftablesConn(t.netNS, true)
+		if err != nil {
+			return err
+		}
+	}
+	err = ruleset.apply(t.nftConn)
+	if err != nil {
+		return err
+	}
+	t.nftRuleset = ruleset
+	return nil
+}
+
+// unsetNftables removes the private table installed by applyNftables.
+func (t *NativeTun) unsetNftables() error {
+	if t.nftConn == nil {
+		return nil
+	}
+	err := deleteNftablesTable(t.nftConn, nftablesTableName(t.options.Name))
+	if err != nil {
+		return err
+	}
+	t.nftRuleset = nil
+	return t.journal(func(state *linuxState) {
+		state.Nftables = ""
+	})
+}
+
+// replaceNftables applies the private table of next if it differs from the
+// one in place.
+func (t *NativeTun) replaceNftables(next *NativeTun, undo *rollback) error {
+	ruleset, err := next.nftablesRuleset()
+	if err != nil {
+		return err
+	}
+	oldRuleset := t.nftRuleset
+	if slices.Equal(oldRuleset.commands(), ruleset.commands()) {
+		return nil
+	}
+	err = t.applyNftables(ruleset)
+	if err != nil {
+		return err
+	}
+	undo.push(func() error {
+		return t.applyNftables(oldRuleset)
+	})
+	return nil
+}
+
+func (t *NativeTun) closeNftables() {
+	if t.nftConn != nil {
+		t.nftConn.CloseLasting()
+		t.nftConn = nil
+	}
+}
+
+// deleteNftables removes the private table name from ns, if it exists.
+func deleteNftables(ns netns.NsHandle, name string) error {
+	conn, err := newNftablesConn(ns, false)
+	if err != nil {
+		return err
+	}
+	return deleteNftablesTable(conn, name)
+}
+
+func deleteNftablesTable(conn *nftables.Conn, name string) error {
+	conn.DelTable(&nftables.Table{Family: nftables.TableFamilyINet, Name: name})
+	return ignoreNotFound(conn.Flush())
+}
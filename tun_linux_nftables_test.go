@@ -0,0 +1,59 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNftablesExcludePort(t *testing.T) {
+	tun := testTun(Options{
+		ExcludePort: []PortRange{{Start: 22, End: 22}, {Start: 8000, End: 8999}, {Start: 8500, End: 9000}},
+	})
+	_, err := tun.nftablesRuleset()
+	if !errors.Is(err, ErrOutboundMarkRequired) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tun.options.OutboundMark = 0x10
+	ruleset, err := tun.nftablesRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// overlapping ranges are merged
+	assertEqualCommands(t, ruleset.commands(),
+		"add table inet cropstun_tun0",
+		"add set inet cropstun_tun0 exclude_port '{ type inet_service; flags interval; }'",
+		"add element inet cropstun_tun0 exclude_port '{ 22, 8000-9000 }'",
+		"add chain inet cropstun_tun0 output '{ type route hook output priority mangle; }'",
+		"add rule inet cropstun_tun0 output meta l4proto tcp th dport @exclude_port meta mark set 0x10",
+		"add rule inet cropstun_tun0 output meta l4proto udp th dport @exclude_port meta mark set 0x10",
+		"add chain inet cropstun_tun0 postrouting '{ type nat hook postrouting priority srcnat; }'",
+		`add rule inet cropstun_tun0 postrouting ip saddr 198.18.0.1 oifname != "tun0" masquerade`,
+	)
+}
+
+func TestNftablesReturnInbound(t *testing.T) {
+	tun := testTun(Options{ReturnInbound: true})
+	_, err := tun.nftablesRuleset()
+	if !errors.Is(err, ErrOutboundMarkRequired) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tun.options.OutboundMark = 0x10
+	ruleset, err := tun.nftablesRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing leaves the tun unmarked, so nothing is masqueraded
+	assertEqualCommands(t, ruleset.commands(),
+		"add table inet cropstun_tun0",
+		"add chain inet cropstun_tun0 output '{ type route hook output priority mangle; }'",
+		"add rule inet cropstun_tun0 output ct mark 0x10 meta mark set 0x10",
+		"add chain inet cropstun_tun0 prerouting '{ type filter hook prerouting priority mangle; }'",
+		`add rule inet cropstun_tun0 prerouting iifname != "tun0" ct state new fib daddr type local meta mark set 0x10 ct mark set meta mark`,
+	)
+	if !slices.Contains(tun.sysctls(), Sysctl{Key: "net.ipv4.tcp_fwmark_accept", Value: "1"}) {
+		t.Errorf("unexpected sysctls %v", tun.sysctls())
+	}
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package tun
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDeviceOwnership applies Owner, Group and Persist to the device of fd.
+func setDeviceOwnership(fd int, options *Options) error {
+	if options.Owner != 0 {
+		err := tunIoctl(fd, unix.TUNSETOWNER, uintptr(options.Owner), "TUNSETOWNER")
+		if err != nil {
+			return err
+		}
+	}
+	if options.Group != 0 {
+		err := tunIoctl(fd, unix.TUNSETGROUP, uintptr(options.Group), "TUNSETGROUP")
+		if err != nil {
+			return err
+		}
+	}
+	if options.Persist {
+		return tunIoctl(fd, unix.TUNSETPERSIST, 1, "TUNSETPERSIST")
+	}
+	return nil
+}
+
+func tunIoctl(fd int, req uint, value uintptr, name string) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), value)
+	if errno != 0 {
+		return os.NewSyscallError(name, errno)
+	}
+	return nil
+}
+
+// CreateDevice creates the persistent tun device Name with the MTU,
+// transmit queue length and addresses of options, owned by Owner and Group,
+// and brings it up. It fails if the device exists. A process running as
+// Owner or in Group can then open the device with Attach and without
+// CAP_NET_ADMIN.
+func CreateDevice(options *Options) error {
+	ns, nlHandle, err := openNetNS(options.NetNS)
+	if err != nil {
+		return err
+	}
+	defer closeNetNS(ns, nlHandle)
+	flags := uint16(unix.IFF_TUN_EXCL)
+	if options.Queues > 1 {
+		flags |= unix.IFF_MULTI_QUEUE
+	}
+	if options.GSO {
+		flags |= unix.IFF_VNET_HDR
+	}
+	var fd int
+	err = inNetNS(ns, func() (err error) {
+		fd, err = open(options.Name, flags)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	deviceOptions := *options
+	deviceOptions.Persist = true
+	err = setDeviceOwnership(fd, &deviceOptions)
+	if err != nil {
+		return err
+	}
+	t := &NativeTun{
+		options:  &deviceOptions,
+		netNS:    ns,
+		nlHandle: nlHandle,
+	}
+	tunLink, err := nlHandle.LinkByName(options.Name)
+	if err == nil {
+		err = t.configureLink(tunLink)
+	}
+	if err != nil {
+		_ = tunIoctl(fd, unix.TUNSETPERSIST, 0, "TUNSETPERSIST")
+		return err
+	}
+	return nil
+}
+
+// DeleteDevice deletes the tun device Name, such as one made by
+// CreateDevice, in the namespace NetNS of options.
+func DeleteDevice(options *Options) error {
+	ns, nlHandle, err := openNetNS(options.NetNS)
+	if err != nil {
+		return err
+	}
+	defer closeNetNS(ns, nlHandle)
+	tunLink, err := nlHandle.LinkByName(options.Name)
+	if err != nil {
+		return err
+	}
+	return nlHandle.LinkDel(tunLink)
+}
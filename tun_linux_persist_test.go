@@ -0,0 +1,90 @@
+//go:build linux
+
+package tun
+
+import (
+	"net/netip"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// newTestNetNS creates a namespace for a test that changes devices or
+// kernel parameters, and returns its path.
+func newTestNetNS(t *testing.T) (netns.NsHandle, string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	ns, err := newNetNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ns.Close()
+	})
+	return ns, "/proc/self/fd/" + strconv.Itoa(int(ns))
+}
+
+func TestCreateDevice(t *testing.T) {
+	_, path := newTestNetNS(t)
+	options := &Options{
+		Name:         "tun9",
+		MTU:          1400,
+		TxQueueLen:   100,
+		Owner:        1000,
+		Group:        1000,
+		NetNS:        path,
+		Inet4Address: []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")},
+	}
+	err := CreateDevice(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CreateDevice(options) == nil {
+		t.Error("created an existing device again")
+	}
+	ns, nlHandle, err := openNetNS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNetNS(ns, nlHandle)
+	link, err := nlHandle.LinkByName("tun9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunLink, ok := link.(*netlink.Tuntap)
+	if !ok {
+		t.Fatalf("unexpected link type %s", link.Type())
+	}
+	if tunLink.Owner != 1000 || tunLink.Group != 1000 || tunLink.NonPersist {
+		t.Errorf("unexpected owner %d, group %d or non persist %v", tunLink.Owner, tunLink.Group, tunLink.NonPersist)
+	}
+	if attrs := tunLink.Attrs(); attrs.MTU != 1400 || attrs.TxQLen != 100 {
+		t.Errorf("unexpected MTU %d or txqueuelen %d", attrs.MTU, attrs.TxQLen)
+	}
+
+	// a persistent device survives the tuns attached to it
+	tun, err := New(&Options{Name: "tun9", MTU: 1400, NetNS: path, Attach: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tun.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = nlHandle.LinkByName("tun9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteDevice(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = nlHandle.LinkByName("tun9"); err == nil {
+		t.Error("the device was not deleted")
+	}
+}
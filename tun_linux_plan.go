@@ -0,0 +1,264 @@
+//go:build linux
+
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"golang.org/x/sys/unix"
+)
+
+// Plan lists the changes that New would apply to the system for a set of
+// Options, without applying them.
+type Plan struct {
+	Name  string
+	MTU   uint32
+	Flags uint16
+	// Attach is set when the existing device is opened, which is neither
+	// created nor configured.
+	Attach     bool
+	TxQueueLen int
+	Owner      uint32
+	Group      uint32
+	// Persist keeps the device after the tun is closed. The device made by
+	// ip tuntap is always persistent.
+	Persist   bool
+	Addresses []netip.Prefix
+	Routes    []netlink.Route
+	Rules     []*netlink.Rule
+	Sysctls   []Sysctl
+	// Nftables holds the nft arguments equivalent to the private table
+	// installed through netlink.
+	Nftables []string
+	// DNS holds the resolvectl arguments run by SetupDNS.
+	DNS [][]string
+}
+
+// Sysctl is a kernel parameter and the value it is set to.
+type Sysctl struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// NewPlan computes the Plan of options. dnsServers are the servers that
+// would be passed to SetupDNS, if any. The routing policy database of the
+// target namespace is read, never written, to allocate the rule priorities
+// and route table.
+func NewPlan(options *Options, dnsServers []netip.Addr) (*Plan, error) {
+	plan := &Plan{
+		Name:       options.Name,
+		MTU:        options.MTU,
+		Attach:     options.Attach,
+		TxQueueLen: options.TxQueueLen,
+		Owner:      options.Owner,
+		Group:      options.Group,
+		Persist:    options.Persist,
+	}
+	if options.FileDescriptor != nil {
+		// an adopted device is configured by its owner
+		return plan, nil
+	}
+	if options.Attach && !options.AutoRoute {
+		return plan, nil
+	}
+	ns, nlHandle, err := openNetNS(options.NetNS)
+	if err != nil {
+		return nil, err
+	}
+	defer closeNetNS(ns, nlHandle)
+	planOptions := *options
+	t := &NativeTun{
+		options:  &planOptions,
+		netNS:    ns,
+		nlHandle: nlHandle,
+	}
+	err = t.allocate(false)
+	if err != nil {
+		return nil, err
+	}
+	if options.Queues > 1 {
+		plan.Flags |= unix.IFF_MULTI_QUEUE
+	}
+	if options.GSO {
+		plan.Flags |= unix.IFF_VNET_HDR
+	}
+	if !options.Attach {
+		plan.Addresses = append(plan.Addresses, options.Inet4Address...)
+		plan.Addresses = append(plan.Addresses, options.Inet6Address...)
+	}
+	plan.Routes, err = t.routes(&netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: options.Name}})
+	if err != nil {
+		return nil, err
+	}
+	if t.killSwitch() {
+		killSwitchRoutes, err := t.killSwitchRoutes()
+		if err != nil {
+			return nil, err
+		}
+		plan.Routes = append(plan.Routes, killSwitchRoutes...)
+	}
+	plan.Rules = t.rules()
+	for _, rule := range plan.Rules {
+		rule.Protocol = ruleProtocol
+	}
+	plan.Sysctls = t.sysctls()
+	ruleset, err := t.nftablesRuleset()
+	if err != nil {
+		return nil, err
+	}
+	if ruleset != nil {
+		plan.Nftables = ruleset.commands()
+	}
+	if len(dnsServers) > 0 {
+		plan.DNS = t.dnsCommands(dnsServers)
+	}
+	return plan, nil
+}
+
+// Commands renders the plan as the equivalent ip, sysctl, nft and resolvectl
+// commands, in the order they are applied.
+func (p *Plan) Commands() []string {
+	var commands []string
+	if !p.Attach {
+		commands = append(commands, p.tuntapCommand())
+		commands = append(commands, fmt.Sprintf("ip link set dev %s mtu %d", p.Name, p.MTU))
+		if p.TxQueueLen > 0 {
+			commands = append(commands, fmt.Sprintf("ip link set dev %s txqueuelen %d", p.Name, p.TxQueueLen))
+		}
+		for _, address := range p.Addresses {
+			commands = append(commands, fmt.Sprintf("ip addr add %s dev %s", address, p.Name))
+		}
+		commands = append(commands, fmt.Sprintf("ip link set dev %s up", p.Name))
+	}
+	for _, route := range p.Routes {
+		commands = append(commands, p.routeCommand(route))
+	}
+	for _, rule := range p.Rules {
+		commands = append(commands, ruleCommand(rule))
+	}
+	for _, sysctl := range p.Sysctls {
+		commands = append(commands, fmt.Sprintf("sysctl -w %s=%s", sysctl.Key, sysctl.Value))
+	}
+	for _, args := range p.Nftables {
+		commands = append(commands, "nft "+args)
+	}
+	for _, args := range p.DNS {
+		commands = append(commands, "resolvectl "+strings.Join(args, " "))
+	}
+	return commands
+}
+
+func (p *Plan) String() string {
+	return strings.Join(p.Commands(), "\n")
+}
+
+func (p *Plan) tuntapCommand() string {
+	command := "ip tuntap add mode tun name " + p.Name
+	if p.Owner != 0 {
+		command += " user " + strconv.FormatUint(uint64(p.Owner), 10)
+	}
+	if p.Group != 0 {
+		command += " group " + strconv.FormatUint(uint64(p.Group), 10)
+	}
+	if p.Flags&unix.IFF_MULTI_QUEUE != 0 {
+		command += " multi_queue"
+	}
+	if p.Flags&unix.IFF_VNET_HDR != 0 {
+		command += " vnet_hdr"
+	}
+	return command
+}
+
+func (p *Plan) routeCommand(route netlink.Route) string {
+	var command strings.Builder
+	command.WriteString("ip route add ")
+	if route.Type == unix.RTN_UNREACHABLE {
+		command.WriteString("unreachable ")
+	}
+	command.WriteString(route.Dst.String())
+	if route.Type != unix.RTN_UNREACHABLE {
+		command.WriteString(" dev " + p.Name)
+	}
+	if route.Priority > 0 {
+		command.WriteString(" metric " + strconv.Itoa(route.Priority))
+	}
+	command.WriteString(" table " + tableName(route.Table))
+	return command.String()
+}
+
+func ruleCommand(rule *netlink.Rule) string {
+	var command strings.Builder
+	command.WriteString("ip ")
+	if rule.Family == unix.AF_INET6 {
+		command.WriteString("-6 ")
+	}
+	command.WriteString("rule add ")
+	if rule.Invert {
+		command.WriteString("not ")
+	}
+	command.WriteString("priority " + strconv.Itoa(rule.Priority))
+	if rule.Src != nil {
+		command.WriteString(" from " + rule.Src.String())
+	}
+	if rule.Dst != nil {
+		command.WriteString(" to " + rule.Dst.String())
+	}
+	if rule.Mark != 0 {
+		fmt.Fprintf(&command, " fwmark 0x%x", rule.Mark)
+		if rule.Mask != nil {
+			fmt.Fprintf(&command, "/0x%x", *rule.Mask)
+		}
+	}
+	if rule.IifName != "" {
+		command.WriteString(" iif " + rule.IifName)
+	}
+	if rule.OifName != "" {
+		command.WriteString(" oif " + rule.OifName)
+	}
+	if rule.UIDRange != nil {
+		fmt.Fprintf(&command, " uidrange %d-%d", rule.UIDRange.Start, rule.UIDRange.End)
+	}
+	if rule.Dport != nil {
+		fmt.Fprintf(&command, " dport %d-%d", rule.Dport.Start, rule.Dport.End)
+	}
+	switch {
+	case rule.Goto >= 0:
+		command.WriteString(" goto " + strconv.Itoa(rule.Goto))
+	case rule.Type == nl.FR_ACT_NOP:
+		command.WriteString(" nop")
+	case rule.Type == nl.FR_ACT_UNREACHABLE:
+		command.WriteString(" unreachable")
+	case rule.Type == nl.FR_ACT_PROHIBIT:
+		command.WriteString(" prohibit")
+	case rule.Type == nl.FR_ACT_BLACKHOLE:
+		command.WriteString(" blackhole")
+	default:
+		command.WriteString(" lookup " + tableName(rule.Table))
+	}
+	if rule.SuppressPrefixlen >= 0 {
+		command.WriteString(" suppress_prefixlength " + strconv.Itoa(rule.SuppressPrefixlen))
+	}
+	if rule.Protocol != 0 {
+		command.WriteString(" protocol " + strconv.Itoa(int(rule.Protocol)))
+	}
+	return command.String()
+}
+
+func tableName(table int) string {
+	switch table {
+	case unix.RT_TABLE_MAIN:
+		return "main"
+	case unix.RT_TABLE_LOCAL:
+		return "local"
+	case unix.RT_TABLE_DEFAULT:
+		return "default"
+	default:
+		return strconv.Itoa(table)
+	}
+}
@@ -0,0 +1,124 @@
+//go:build linux
+
+package tun
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"golang.org/x/sys/unix"
+)
+
+// testTun returns a tun for the rule tests, with fixed indices so that they
+// do not depend on the rules of the host.
+func testTun(options Options) *NativeTun {
+	if options.Name == "" {
+		options.Name = "tun0"
+	}
+	if len(options.Inet4Address) == 0 && len(options.Inet6Address) == 0 {
+		options.Inet4Address = []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")}
+	}
+	options.AutoRoute = true
+	options.IPRoute2TableIndex = DefaultIPRoute2TableIndex
+	options.IPRoute2RuleIndex = DefaultIPRoute2RuleIndex
+	return &NativeTun{options: &options}
+}
+
+func ruleCommands(rules []*netlink.Rule) []string {
+	commands := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		commands = append(commands, ruleCommand(rule))
+	}
+	return commands
+}
+
+func assertCommands(t *testing.T, commands []string, expected ...string) {
+	t.Helper()
+	for _, command := range expected {
+		if !slices.Contains(commands, command) {
+			t.Errorf("missing %q in:\n%s", command, strings.Join(commands, "\n"))
+		}
+	}
+}
+
+func assertEqualCommands(t *testing.T, commands []string, expected ...string) {
+	t.Helper()
+	if !slices.Equal(commands, expected) {
+		t.Errorf("unexpected commands:\n%s\nexpected:\n%s", strings.Join(commands, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestPlanCommands(t *testing.T) {
+	plan, err := NewPlan(&Options{
+		Name:                "tun0",
+		MTU:                 1500,
+		Inet4Address:        []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")},
+		AutoRoute:           true,
+		IPRoute2TableIndex:  DefaultIPRoute2TableIndex,
+		IPRoute2RuleIndex:   DefaultIPRoute2RuleIndex,
+		RouteAddress:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		RouteExcludeAddress: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/9")},
+		OutboundMark:        0x10,
+		KillSwitch:          true,
+	}, []netip.Addr{netip.MustParseAddr("1.1.1.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := plan.Commands()
+	for _, expected := range []string{
+		"ip tuntap add mode tun name tun0",
+		"ip addr add 198.18.0.1/16 dev tun0",
+		"ip route add 10.128.0.0/9 dev tun0 table 4000",
+		"ip route add unreachable 10.128.0.0/9 metric 2147483647 table 4000",
+		"ip rule add priority 10086 fwmark 0x10 lookup main protocol 207",
+		"ip rule add not priority 10089 dport 53-53 lookup main suppress_prefixlength 0 protocol 207",
+		"ip rule add priority 10096 nop protocol 207",
+		"resolvectl dns tun0 1.1.1.1",
+	} {
+		if !slices.Contains(commands, expected) {
+			t.Errorf("missing %q in:\n%s", expected, plan)
+		}
+	}
+}
+
+func TestPlanDevice(t *testing.T) {
+	plan := &Plan{
+		Name:       "tun0",
+		MTU:        1500,
+		Flags:      unix.IFF_MULTI_QUEUE,
+		TxQueueLen: 100,
+		Owner:      1000,
+		Group:      1001,
+		Persist:    true,
+		Addresses:  []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")},
+	}
+	expected := []string{
+		"ip tuntap add mode tun name tun0 user 1000 group 1001 multi_queue",
+		"ip link set dev tun0 mtu 1500",
+		"ip link set dev tun0 txqueuelen 100",
+		"ip addr add 198.18.0.1/16 dev tun0",
+		"ip link set dev tun0 up",
+	}
+	if commands := plan.Commands(); !slices.Equal(commands, expected) {
+		t.Errorf("unexpected commands:\n%s", plan)
+	}
+
+	// an attached device is neither created nor configured
+	plan, err := NewPlan(&Options{
+		Name:         "tun0",
+		MTU:          1500,
+		Inet4Address: []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")},
+		TxQueueLen:   100,
+		Attach:       true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commands := plan.Commands(); len(commands) > 0 {
+		t.Errorf("unexpected commands for an attached device:\n%s", plan)
+	}
+}
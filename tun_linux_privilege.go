@@ -0,0 +1,92 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+
+	"golang.org/x/sys/unix"
+)
+
+// DropPrivileges switches the whole process to uid and gid once the device
+// is set up, so that handlers never run as root. The netlink sockets used by
+// Close are opened beforehand, and CAP_NET_ADMIN is kept when Close still
+// has routes or rules to remove, or OutboundMark is set; CAP_NET_RAW is
+// kept if keepNetRaw is set, for sockets bound to a device by the bind
+// package. The directory of StatePath must be writable by uid.
+//
+// Credentials are per thread on Linux and are changed on every thread of
+// the Go runtime, which is not possible in binaries that use cgo.
+func (t *NativeTun) DropPrivileges(uid, gid int, keepNetRaw bool) error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if !t.netNS.IsOpen() {
+		nlHandle, err := netlink.NewHandle(unix.NETLINK_ROUTE)
+		if err != nil {
+			return err
+		}
+		t.nlHandle = nlHandle
+	}
+	var capabilities uint32
+	if t.needsTeardown() || t.options.OutboundMark != 0 {
+		capabilities |= 1 << unix.CAP_NET_ADMIN
+	}
+	if keepNetRaw {
+		capabilities |= 1 << unix.CAP_NET_RAW
+	}
+	return dropPrivileges(uid, gid, capabilities)
+}
+
+// needsTeardown reports whether Close has routes or rules to remove.
+func (t *NativeTun) needsTeardown() bool {
+	if t.options.FileDescriptor != nil {
+		return false
+	}
+	return !t.options.Attach || t.options.AutoRoute
+}
+
+func dropPrivileges(uid, gid int, capabilities uint32) error {
+	// keep the permitted capabilities across the switch from uid 0
+	err := allThreadsSyscall("prctl", unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0)
+	if err != nil {
+		return err
+	}
+	err = syscall.Setgroups(nil)
+	if err != nil {
+		return os.NewSyscallError("setgroups", err)
+	}
+	err = syscall.Setresgid(gid, gid, gid)
+	if err != nil {
+		return os.NewSyscallError("setresgid", err)
+	}
+	err = syscall.Setresuid(uid, uid, uid)
+	if err != nil {
+		return os.NewSyscallError("setresuid", err)
+	}
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{{
+		Effective: capabilities,
+		Permitted: capabilities,
+	}}
+	err = allThreadsSyscall("capset", unix.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if err != nil {
+		return err
+	}
+	return allThreadsSyscall("prctl", unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 0, 0)
+}
+
+func allThreadsSyscall(name string, trap, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("%s: %w", name, errors.ErrUnsupported)
+	} else if errno != 0 {
+		return os.NewSyscallError(name, errno)
+	}
+	return nil
+}
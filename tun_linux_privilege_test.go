@@ -0,0 +1,78 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNeedsTeardown(t *testing.T) {
+	fd := 0
+	for _, test := range []struct {
+		options  Options
+		expected bool
+	}{
+		{Options{}, true},
+		{Options{Attach: true}, false},
+		{Options{Attach: true, AutoRoute: true}, true},
+		{Options{FileDescriptor: &fd, AutoRoute: true}, false},
+	} {
+		tun := &NativeTun{options: &test.options}
+		if tun.needsTeardown() != test.expected {
+			t.Errorf("needsTeardown of %+v is not %v", test.options, test.expected)
+		}
+	}
+}
+
+// TestDropPrivileges runs itself in a child process, since the credentials
+// of the whole process are changed.
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv("TUN_TEST_DROP_PRIVILEGES") != "" {
+		err := dropPrivileges(65534, 65534, 1<<unix.CAP_NET_ADMIN)
+		if errors.Is(err, errors.ErrUnsupported) {
+			// the test binary uses cgo
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks, err := filepath.Glob("/proc/self/task/*/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, task := range tasks {
+			content, err := os.ReadFile(task)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := string(content)
+			for _, expected := range []string{
+				"Uid:\t65534\t65534\t65534\t65534",
+				"Gid:\t65534\t65534\t65534\t65534",
+				"CapEff:\t0000000000001000",
+				"CapPrm:\t0000000000001000",
+			} {
+				if !strings.Contains(status, expected) {
+					t.Errorf("missing %q in %s", expected, task)
+				}
+			}
+		}
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges needs root")
+	}
+	command := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	command.Env = append(os.Environ(), "TUN_TEST_DROP_PRIVILEGES=1")
+	output, err := command.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+package tun
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+
+	"golang.org/x/sys/unix"
+)
+
+// addRule adds rule to the routing policy database. netlink only encodes
+// suppress_prefixlength for tables below 256, which would silently turn
+// `lookup T suppress_prefixlength 0` into a plain lookup of T, so such
+// rules are encoded here instead.
+func (t *NativeTun) addRule(rule *netlink.Rule) error {
+	if rule.SuppressPrefixlen < 0 || rule.Table < 256 {
+		return t.nlHandle.RuleAdd(rule)
+	}
+	return addSuppressRule(t.netNS, rule)
+}
+
+// addSuppressRule adds a rule with a lookup, suppress_prefixlength and the
+// selectors used along with them by the auto-route rules. The sockets of
+// a netlink.Handle are not exported, so the request goes through a socket
+// of its own opened in ns.
+func addSuppressRule(ns netns.NsHandle, rule *netlink.Rule) error {
+	socket, err := nl.GetNetlinkSocketAt(ns, netns.None(), unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+	req := nl.NewNetlinkRequest(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(rule.Family)
+	msg.Protocol = unix.RTPROT_BOOT
+	msg.Scope = unix.RT_SCOPE_UNIVERSE
+	msg.Table = unix.RT_TABLE_UNSPEC
+	msg.Type = unix.RTN_UNICAST
+	if rule.Invert {
+		msg.Flags |= netlink.FibRuleInvert
+	}
+	var attrs []*nl.RtAttr
+	if rule.Dst != nil {
+		dstLen, _ := rule.Dst.Mask.Size()
+		msg.Dst_len = uint8(dstLen)
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_DST, familyIP(rule.Family, rule.Dst.IP)))
+	}
+	if rule.Src != nil {
+		srcLen, _ := rule.Src.Mask.Size()
+		msg.Src_len = uint8(srcLen)
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_SRC, familyIP(rule.Family, rule.Src.IP)))
+	}
+	req.Sockets = map[int]*nl.SocketHandle{unix.NETLINK_ROUTE: {Socket: socket}}
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	native := nl.NativeEndian()
+	putUint32 := func(attrType int, value uint32) {
+		b := make([]byte, 4)
+		native.PutUint32(b, value)
+		req.AddData(nl.NewRtAttr(attrType, b))
+	}
+	if rule.Priority >= 0 {
+		putUint32(nl.FRA_PRIORITY, uint32(rule.Priority))
+	}
+	putUint32(nl.FRA_TABLE, uint32(rule.Table))
+	putUint32(nl.FRA_SUPPRESS_PREFIXLEN, uint32(rule.SuppressPrefixlen))
+	if rule.IifName != "" {
+		req.AddData(nl.NewRtAttr(nl.FRA_IIFNAME, nl.ZeroTerminated(rule.IifName)))
+	}
+	if rule.OifName != "" {
+		req.AddData(nl.NewRtAttr(nl.FRA_OIFNAME, nl.ZeroTerminated(rule.OifName)))
+	}
+	if rule.Protocol > 0 {
+		req.AddData(nl.NewRtAttr(nl.FRA_PROTOCOL, nl.Uint8Attr(rule.Protocol)))
+	}
+	_, err = req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+func familyIP(family int, ip net.IP) []byte {
+	if family == unix.AF_INET {
+		return ip.To4()
+	}
+	return ip.To16()
+}
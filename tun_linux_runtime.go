@@ -0,0 +1,444 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Route is an extra route through the tun device.
+type Route struct {
+	Destination netip.Prefix
+	// Metric is the route priority, lower values are preferred.
+	Metric int
+	// Table is the route table, zero selects main.
+	Table int
+}
+
+// RuleSelectors are the auto-route selectors of Options.
+type RuleSelectors struct {
+	IncludeUID       []UIDRange
+	ExcludeUID       []UIDRange
+	IncludeInterface []string
+	ExcludeInterface []string
+	IncludeSource    []netip.Prefix
+	ExcludeSource    []netip.Prefix
+	IncludeCgroup    []string
+	ExcludeCgroup    []string
+}
+
+// rollback collects the inverse of the changes applied so far, to revert
+// them in reverse order when a later change fails.
+type rollback []func() error
+
+func (r *rollback) push(undo func() error) {
+	*r = append(*r, undo)
+}
+
+func (r rollback) run(err error) error {
+	errs := []error{err}
+	for i := len(r) - 1; i >= 0; i-- {
+		errs = append(errs, r[i]())
+	}
+	return errors.Join(errs...)
+}
+
+// AddAddress assigns prefixes to the tun device, updating the auto-route
+// routes and rules that depend on the address families and prefixes.
+func (t *NativeTun) AddAddress(prefixes ...netip.Prefix) error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	options := *t.options
+	options.Inet4Address = slices.Clone(options.Inet4Address)
+	options.Inet6Address = slices.Clone(options.Inet6Address)
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is4() {
+			options.Inet4Address = append(options.Inet4Address, prefix)
+		} else {
+			options.Inet6Address = append(options.Inet6Address, prefix)
+		}
+	}
+	return t.reconfigure(&options)
+}
+
+// RemoveAddress is the inverse of AddAddress.
+func (t *NativeTun) RemoveAddress(prefixes ...netip.Prefix) error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	options := *t.options
+	options.Inet4Address = slices.DeleteFunc(slices.Clone(options.Inet4Address), func(it netip.Prefix) bool {
+		return slices.Contains(prefixes, it)
+	})
+	options.Inet6Address = slices.DeleteFunc(slices.Clone(options.Inet6Address), func(it netip.Prefix) bool {
+		return slices.Contains(prefixes, it)
+	})
+	return t.reconfigure(&options)
+}
+
+// SetRouteAddress replaces RouteAddress and RouteExcludeAddress. Routes to
+// new ranges are added before the routes to dropped ones are removed, so
+// established connections keep flowing.
+func (t *NativeTun) SetRouteAddress(routeAddress, routeExcludeAddress []netip.Prefix) error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	options := *t.options
+	options.RouteAddress = routeAddress
+	options.RouteExcludeAddress = routeExcludeAddress
+	return t.reconfigure(&options)
+}
+
+// SetRuleSelectors replaces the auto-route selectors.
+func (t *NativeTun) SetRuleSelectors(selectors RuleSelectors) error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	options := *t.options
+	options.IncludeUID = selectors.IncludeUID
+	options.ExcludeUID = selectors.ExcludeUID
+	options.IncludeInterface = selectors.IncludeInterface
+	options.ExcludeInterface = selectors.ExcludeInterface
+	options.IncludeSource = selectors.IncludeSource
+	options.ExcludeSource = selectors.ExcludeSource
+	options.IncludeCgroup = selectors.IncludeCgroup
+	options.ExcludeCgroup = selectors.ExcludeCgroup
+	return t.reconfigure(&options)
+}
+
+// AddRoute adds extra routes through the tun device. Either all of them are
+// added or none.
+func (t *NativeTun) AddRoute(routes ...Route) error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	tunLink, err := t.nlHandle.LinkByName(t.options.Name)
+	if err != nil {
+		return err
+	}
+	var undo rollback
+	err = t.addRoutes(extraRoutes(tunLink, routes), &undo)
+	if err != nil {
+		return undo.run(err)
+	}
+	t.addedRoutes = append(t.addedRoutes, routes...)
+	return nil
+}
+
+// RemoveRoute removes routes added by AddRoute. Either all of them are
+// removed or none.
+func (t *NativeTun) RemoveRoute(routes ...Route) error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	tunLink, err := t.nlHandle.LinkByName(t.options.Name)
+	if err != nil {
+		return err
+	}
+	var undo rollback
+	err = t.delRoutes(extraRoutes(tunLink, routes), &undo)
+	if err != nil {
+		return undo.run(err)
+	}
+	t.addedRoutes = slices.DeleteFunc(t.addedRoutes, func(it Route) bool {
+		return slices.Contains(routes, it)
+	})
+	return nil
+}
+
+// unsetAddedRoutes removes the routes added by AddRoute, which outlive Close
+// on a device that is not deleted, like those of Persist and Attach.
+func (t *NativeTun) unsetAddedRoutes() {
+	tunLink, err := t.nlHandle.LinkByName(t.options.Name)
+	if err != nil {
+		return
+	}
+	for _, route := range extraRoutes(tunLink, t.addedRoutes) {
+		_ = t.nlHandle.RouteDel(&route)
+	}
+	t.addedRoutes = nil
+}
+
+func extraRoutes(tunLink netlink.Link, routes []Route) []netlink.Route {
+	extraRoutes := make([]netlink.Route, 0, len(routes))
+	for _, route := range routes {
+		extraRoutes = append(extraRoutes, netlink.Route{
+			Dst:       prefixToIPNet(route.Destination.Masked()),
+			LinkIndex: tunLink.Attrs().Index,
+			Priority:  route.Metric,
+			Table:     route.Table,
+		})
+	}
+	return extraRoutes
+}
+
+// reconfigure moves the addresses, routes and rules of the device from
+// t.options to options, and reverts to t.options if a step fails.
+func (t *NativeTun) reconfigure(options *Options) error {
+	tunLink, err := t.nlHandle.LinkByName(t.options.Name)
+	if err != nil {
+		return err
+	}
+	next := &NativeTun{options: options}
+	var undo rollback
+
+	oldAddresses := append(slices.Clone(t.options.Inet4Address), t.options.Inet6Address...)
+	newAddresses := append(slices.Clone(options.Inet4Address), options.Inet6Address...)
+	for _, address := range newAddresses {
+		if slices.Contains(oldAddresses, address) {
+			continue
+		}
+		err = t.addAddress(tunLink, address)
+		if err != nil {
+			return undo.run(err)
+		}
+		undo.push(func() error {
+			return t.delAddress(tunLink, address)
+		})
+	}
+
+	oldRoutes, err := t.autoRoutes(tunLink)
+	if err != nil {
+		return undo.run(err)
+	}
+	newRoutes, err := next.autoRoutes(tunLink)
+	if err != nil {
+		return undo.run(err)
+	}
+	addedRoutes, removedRoutes := diffRoutes(oldRoutes, newRoutes)
+	err = t.addRoutes(addedRoutes, &undo)
+	if err != nil {
+		return undo.run(err)
+	}
+
+	err = t.replaceRules(t.rules(), next.rules(), &undo)
+	if err != nil {
+		return undo.run(err)
+	}
+
+	err = t.replaceNftables(next, &undo)
+	if err != nil {
+		return undo.run(err)
+	}
+
+	err = t.delRoutes(removedRoutes, &undo)
+	if err != nil {
+		return undo.run(err)
+	}
+	for _, address := range oldAddresses {
+		if slices.Contains(newAddresses, address) {
+			continue
+		}
+		err = t.delAddress(tunLink, address)
+		if err != nil {
+			return undo.run(err)
+		}
+		undo.push(func() error {
+			return t.addAddress(tunLink, address)
+		})
+	}
+	oldOptions := *t.options
+	*t.options = *options
+	// kernel parameters needed by the new options, such as the forwarding
+	// of an added address family, are kept until Close like the others
+	err = t.setSysctls()
+	if err != nil {
+		*t.options = oldOptions
+		return undo.run(err)
+	}
+	return nil
+}
+
+// diffRoutes returns the routes of newRoutes missing from oldRoutes, and
+// those of oldRoutes missing from newRoutes.
+func diffRoutes(oldRoutes, newRoutes []netlink.Route) (added, removed []netlink.Route) {
+	for _, route := range newRoutes {
+		if !slices.ContainsFunc(oldRoutes, route.Equal) {
+			added = append(added, route)
+		}
+	}
+	for _, route := range oldRoutes {
+		if !slices.ContainsFunc(newRoutes, route.Equal) {
+			removed = append(removed, route)
+		}
+	}
+	return
+}
+
+// autoRoutes returns the routes of the auto-route ranges, with the blocking
+// routes of the kill switch.
+func (t *NativeTun) autoRoutes(tunLink netlink.Link) ([]netlink.Route, error) {
+	routes, err := t.routes(tunLink)
+	if err != nil {
+		return nil, err
+	}
+	if t.killSwitch() {
+		killSwitchRoutes, err := t.killSwitchRoutes()
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, killSwitchRoutes...)
+	}
+	return routes, nil
+}
+
+// replaceRules replaces the rules of every priority whose rules differ
+// between oldRules and newRules. The rules of a priority are replaced as a
+// whole to keep their order.
+func (t *NativeTun) replaceRules(oldRules, newRules []*netlink.Rule, undo *rollback) error {
+	oldGroups, newGroups := groupRules(oldRules), groupRules(newRules)
+	for _, key := range changedRuleGroups(oldGroups, newGroups) {
+		oldGroup, newGroup := oldGroups[key], newGroups[key]
+		err := t.swapRules(oldGroup, newGroup)
+		if err != nil {
+			return err
+		}
+		undo.push(func() error {
+			return t.swapRules(newGroup, oldGroup)
+		})
+	}
+	return nil
+}
+
+// changedRuleGroups returns, in priority order, the keys of the groups whose
+// rules differ between oldGroups and newGroups.
+func changedRuleGroups(oldGroups, newGroups map[ruleKey][]*netlink.Rule) []ruleKey {
+	var keys []ruleKey
+	for key := range oldGroups {
+		keys = append(keys, key)
+	}
+	for key := range newGroups {
+		if _, loaded := oldGroups[key]; !loaded {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b ruleKey) int {
+		if a.priority != b.priority {
+			return a.priority - b.priority
+		}
+		return a.family - b.family
+	})
+	return slices.DeleteFunc(keys, func(key ruleKey) bool {
+		return slices.EqualFunc(oldGroups[key], newGroups[key], func(a, b *netlink.Rule) bool {
+			return ruleCommand(a) == ruleCommand(b)
+		})
+	})
+}
+
+type ruleKey struct {
+	priority int
+	family   int
+}
+
+func groupRules(rules []*netlink.Rule) map[ruleKey][]*netlink.Rule {
+	groups := make(map[ruleKey][]*netlink.Rule)
+	for _, rule := range rules {
+		rule.Protocol = ruleProtocol
+		key := ruleKey{rule.Priority, rule.Family}
+		groups[key] = append(groups[key], rule)
+	}
+	return groups
+}
+
+func (t *NativeTun) swapRules(oldRules, newRules []*netlink.Rule) error {
+	for _, rule := range oldRules {
+		err := t.nlHandle.RuleDel(rule)
+		if err != nil {
+			return err
+		}
+	}
+	err := t.forgetRules(oldRules)
+	if err != nil {
+		return err
+	}
+	err = t.journalRules(newRules)
+	if err != nil {
+		return err
+	}
+	for _, rule := range newRules {
+		err = t.addRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *NativeTun) addAddress(tunLink netlink.Link, address netip.Prefix) error {
+	err := t.journal(func(state *linuxState) {
+		state.Addresses = append(state.Addresses, address.String())
+	})
+	if err != nil {
+		return err
+	}
+	addr, err := netlink.ParseAddr(address.String())
+	if err != nil {
+		return err
+	}
+	return t.nlHandle.AddrAdd(tunLink, addr)
+}
+
+func (t *NativeTun) delAddress(tunLink netlink.Link, address netip.Prefix) error {
+	addr, err := netlink.ParseAddr(address.String())
+	if err != nil {
+		return err
+	}
+	err = t.nlHandle.AddrDel(tunLink, addr)
+	if err != nil {
+		return err
+	}
+	return t.journal(func(state *linuxState) {
+		state.Addresses = slices.DeleteFunc(state.Addresses, func(it string) bool {
+			return it == address.String()
+		})
+	})
+}
+
+// addRoutes adds routes with a single save of the journal, pushing their
+// removal to undo.
+func (t *NativeTun) addRoutes(routes []netlink.Route, undo *rollback) error {
+	if len(routes) == 0 {
+		return nil
+	}
+	err := t.journalRoutes(routes)
+	if err != nil {
+		return err
+	}
+	undo.push(func() error {
+		return t.forgetRoutes(routes)
+	})
+	for _, route := range routes {
+		err = t.nlHandle.RouteAdd(&route)
+		if err != nil {
+			return err
+		}
+		undo.push(func() error {
+			return t.nlHandle.RouteDel(&route)
+		})
+	}
+	return nil
+}
+
+// delRoutes deletes routes with a single save of the journal, pushing their
+// addition to undo.
+func (t *NativeTun) delRoutes(routes []netlink.Route, undo *rollback) error {
+	if len(routes) == 0 {
+		return nil
+	}
+	for _, route := range routes {
+		err := t.nlHandle.RouteDel(&route)
+		if err != nil {
+			return err
+		}
+		undo.push(func() error {
+			return t.nlHandle.RouteAdd(&route)
+		})
+	}
+	err := t.forgetRoutes(routes)
+	if err != nil {
+		return err
+	}
+	undo.push(func() error {
+		return t.journalRoutes(routes)
+	})
+	return nil
+}
@@ -0,0 +1,99 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	errApply = errors.New("apply")
+	errUndo  = errors.New("undo")
+)
+
+func TestRollback(t *testing.T) {
+	var order []int
+	var undo rollback
+	for i := range 3 {
+		undo.push(func() error {
+			order = append(order, i)
+			if i == 1 {
+				return errUndo
+			}
+			return nil
+		})
+	}
+	err := undo.run(errApply)
+	if !slices.Equal(order, []int{2, 1, 0}) {
+		t.Errorf("undone in order %v", order)
+	}
+	if !errors.Is(err, errApply) || !errors.Is(err, errUndo) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDiffRoutes(t *testing.T) {
+	tunLink := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Index: 5}}
+	oldRoutes := extraRoutes(tunLink, []Route{
+		{Destination: netip.MustParsePrefix("10.0.0.0/8")},
+		{Destination: netip.MustParsePrefix("172.16.0.0/12"), Table: 100},
+	})
+	newRoutes := extraRoutes(tunLink, []Route{
+		{Destination: netip.MustParsePrefix("172.16.0.0/12"), Table: 100},
+		{Destination: netip.MustParsePrefix("192.168.0.0/16"), Metric: 10},
+	})
+	added, removed := diffRoutes(oldRoutes, newRoutes)
+	if len(added) != 1 || added[0].Dst.String() != "192.168.0.0/16" || added[0].Priority != 10 || added[0].LinkIndex != 5 {
+		t.Errorf("unexpected added routes %v", added)
+	}
+	if len(removed) != 1 || removed[0].Dst.String() != "10.0.0.0/8" {
+		t.Errorf("unexpected removed routes %v", removed)
+	}
+	added, removed = diffRoutes(newRoutes, newRoutes)
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("unexpected changes %v %v between equal routes", added, removed)
+	}
+}
+
+func TestChangedRuleGroups(t *testing.T) {
+	options := Options{
+		Name:               "tun0",
+		Inet4Address:       []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")},
+		AutoRoute:          true,
+		IPRoute2TableIndex: DefaultIPRoute2TableIndex,
+		IPRoute2RuleIndex:  DefaultIPRoute2RuleIndex,
+		ExcludeUID:         []UIDRange{{Start: 1000, End: 1000}},
+	}
+	current := &NativeTun{options: &options}
+	nextOptions := options
+	nextOptions.ExcludeUID = []UIDRange{{Start: 2000, End: 2000}}
+	next := &NativeTun{options: &nextOptions}
+
+	keys := changedRuleGroups(groupRules(current.rules()), groupRules(next.rules()))
+	if !slices.Equal(keys, []ruleKey{{DefaultIPRoute2RuleIndex, unix.AF_INET}}) {
+		t.Errorf("unexpected changed groups %v", keys)
+	}
+	// adding the first IPv6 address adds the IPv6 groups and reorders none
+	// of the IPv4 ones
+	nextOptions = options
+	nextOptions.Inet6Address = []netip.Prefix{netip.MustParsePrefix("fdfe:dcba:9876::1/126")}
+	keys = changedRuleGroups(groupRules(current.rules()), groupRules(next.rules()))
+	for _, key := range keys {
+		if key.family != unix.AF_INET6 {
+			t.Errorf("unexpected changed IPv4 group %v", key)
+		}
+	}
+	if len(keys) == 0 {
+		t.Error("missing IPv6 groups")
+	}
+	if keys = changedRuleGroups(groupRules(current.rules()), groupRules(current.rules())); len(keys) != 0 {
+		t.Errorf("unexpected changed groups %v between equal rules", keys)
+	}
+}
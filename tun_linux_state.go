@@ -0,0 +1,250 @@
+//go:build linux
+
+package tun
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"golang.org/x/sys/unix"
+)
+
+// linuxState is the journal of the changes a NativeTun applied to the
+// system. Entries are written before the change is made, so after a crash
+// the journal may name a change that never happened, but never misses one.
+type linuxState struct {
+	Name      string         `json:"name"`
+	NetNS     string         `json:"netns,omitempty"`
+	Addresses []string       `json:"addresses,omitempty"`
+	Routes    []stateRoute   `json:"routes,omitempty"`
+	Rules     []netlink.Rule `json:"rules,omitempty"`
+	DNS       bool           `json:"dns,omitempty"`
+	// Sysctls holds the previous values of the changed kernel parameters.
+	Sysctls []Sysctl `json:"sysctls,omitempty"`
+	// Nftables is the name of the private nftables table.
+	Nftables string `json:"nftables,omitempty"`
+}
+
+type stateRoute struct {
+	Dst    string `json:"dst"`
+	Link   string `json:"link,omitempty"`
+	Table  int    `json:"table"`
+	Type   int    `json:"type,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+}
+
+// journal applies update to the state and saves it to Options.StatePath.
+func (t *NativeTun) journal(update func(state *linuxState)) error {
+	if t.state == nil {
+		return nil
+	}
+	update(t.state)
+	return saveState(t.options.StatePath, t.state)
+}
+
+// journalRoutes records routes with a single save, so that a large set of
+// auto-route ranges is not rewritten once per route.
+func (t *NativeTun) journalRoutes(routes []netlink.Route) error {
+	return t.journal(func(state *linuxState) {
+		for _, route := range routes {
+			state.Routes = append(state.Routes, t.stateRoute(&route))
+		}
+	})
+}
+
+// forgetRoutes removes routes from the journal with a single save.
+func (t *NativeTun) forgetRoutes(routes []netlink.Route) error {
+	return t.journal(func(state *linuxState) {
+		forgotten := make(map[stateRoute]bool, len(routes))
+		for _, route := range routes {
+			forgotten[t.stateRoute(&route)] = true
+		}
+		state.Routes = slices.DeleteFunc(state.Routes, func(it stateRoute) bool {
+			return forgotten[it]
+		})
+	})
+}
+
+func (t *NativeTun) stateRoute(route *netlink.Route) stateRoute {
+	it := stateRoute{
+		Dst:    route.Dst.String(),
+		Table:  route.Table,
+		Type:   route.Type,
+		Metric: route.Priority,
+	}
+	if route.LinkIndex > 0 {
+		it.Link = t.options.Name
+	}
+	return it
+}
+
+// journalRules records rules with a single save.
+func (t *NativeTun) journalRules(rules []*netlink.Rule) error {
+	return t.journal(func(state *linuxState) {
+		for _, rule := range rules {
+			state.Rules = append(state.Rules, *rule)
+		}
+	})
+}
+
+// forgetRules removes rules from the journal with a single save.
+func (t *NativeTun) forgetRules(rules []*netlink.Rule) error {
+	return t.journal(func(state *linuxState) {
+		forgotten := make(map[string]bool, len(rules))
+		for _, rule := range rules {
+			forgotten[ruleCommand(rule)] = true
+		}
+		state.Rules = slices.DeleteFunc(state.Rules, func(it netlink.Rule) bool {
+			return forgotten[ruleCommand(&it)]
+		})
+	})
+}
+
+func saveState(path string, state *linuxState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// rename is atomic, so a crash never leaves a truncated journal
+	err = os.WriteFile(path+".tmp", content, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// undoState reverts everything recorded in the state, newest first, and
+// removes the state file.
+func (t *NativeTun) undoState() error {
+	// the table is removed through the connection opened by New, which
+	// works after DropPrivileges
+	err := t.unsetNftables()
+	if err != nil {
+		return err
+	}
+	err = undoState(t.netNS, t.nlHandle, t.state)
+	if err != nil {
+		return err
+	}
+	t.state = &linuxState{Name: t.options.Name, NetNS: t.options.NetNS}
+	return removeState(t.options.StatePath)
+}
+
+func undoState(ns netns.NsHandle, nlHandle *netlink.Handle, state *linuxState) error {
+	var errs []error
+	if state.Nftables != "" {
+		errs = append(errs, deleteNftables(ns, state.Nftables))
+	}
+	if len(state.Sysctls) > 0 {
+		errs = append(errs, restoreSysctls(ns, state.Sysctls))
+	}
+	if state.DNS {
+		if ctlPath, err := exec.LookPath("resolvectl"); err == nil {
+			_ = execCommandIn(ns, ctlPath, "revert", state.Name)
+		}
+	}
+	for i := len(state.Rules) - 1; i >= 0; i-- {
+		errs = append(errs, ignoreNotFound(nlHandle.RuleDel(&state.Rules[i])))
+	}
+	for i := len(state.Routes) - 1; i >= 0; i-- {
+		errs = append(errs, undoRoute(nlHandle, state.Routes[i]))
+	}
+	if len(state.Addresses) > 0 {
+		if link, err := nlHandle.LinkByName(state.Name); err == nil {
+			for _, address := range state.Addresses {
+				addr, err := netlink.ParseAddr(address)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				errs = append(errs, ignoreNotFound(nlHandle.AddrDel(link, addr)))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func undoRoute(nlHandle *netlink.Handle, it stateRoute) error {
+	_, dst, err := net.ParseCIDR(it.Dst)
+	if err != nil {
+		return err
+	}
+	route := &netlink.Route{
+		Dst:      dst,
+		Table:    it.Table,
+		Type:     it.Type,
+		Priority: it.Metric,
+	}
+	if it.Link != "" {
+		link, err := nlHandle.LinkByName(it.Link)
+		if err != nil {
+			// the routes of a deleted device are gone with it
+			return nil
+		}
+		route.LinkIndex = link.Attrs().Index
+	}
+	return ignoreNotFound(nlHandle.RouteDel(route))
+}
+
+func ignoreNotFound(err error) error {
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENODEV) {
+		return nil
+	}
+	return err
+}
+
+func removeState(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Cleanup reverts the addresses, routes, rules, nftables table and DNS
+// settings recorded in the state file of a previous NativeTun, typically one
+// whose process was killed before it could Close, and removes the file. It
+// does nothing if the file does not exist. New calls it for
+// Options.StatePath before creating the device.
+//
+// The changes are only reverted if Options.NetNS named the namespace by a
+// path that outlives the process, such as /var/run/netns/NAME. A /proc/self
+// path referred to the fds of the crashed process, so the file is removed
+// without reverting anything.
+func Cleanup(statePath string) error {
+	content, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state linuxState
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return err
+	}
+	// a namespace referenced through the fds of the old process is gone or
+	// unreachable, and the same path now means something else
+	if !strings.HasPrefix(state.NetNS, "/proc/self/") {
+		ns, nlHandle, err := openNetNS(state.NetNS)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			err = undoState(ns, nlHandle, &state)
+			closeNetNS(ns, nlHandle)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return removeState(statePath)
+}
@@ -0,0 +1,138 @@
+//go:build linux
+
+package tun
+
+import (
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// newNamedTestNetNS creates a namespace that outlives the fds of the process,
+// as Cleanup only reaches those, and returns its path.
+func newNamedTestNetNS(t *testing.T) string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	ipPath, err := exec.LookPath("ip")
+	if err != nil {
+		t.Skip("ip is not installed")
+	}
+	name := "cropstun-test-" + strconv.Itoa(os.Getpid())
+	output, err := exec.Command(ipPath, "netns", "add", name).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ip netns add: %v: %s", err, output)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command(ipPath, "netns", "delete", name).Run()
+	})
+	return "/var/run/netns/" + name
+}
+
+func TestCleanup(t *testing.T) {
+	path := newNamedTestNetNS(t)
+	statePath := filepath.Join(t.TempDir(), "tun.json")
+	ns, nlHandle, err := openNetNS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNetNS(ns, nlHandle)
+	forward := func() (value string) {
+		err := inNetNS(ns, func() (err error) {
+			value, err = readSysctl("net.ipv4.ip_forward")
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	previousForward := forward()
+
+	tun, err := New(&Options{
+		Name:             "tun7",
+		MTU:              1500,
+		NetNS:            path,
+		Inet4Address:     []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")},
+		AutoRoute:        true,
+		KillSwitch:       true,
+		GatewayInterface: []string{"lo"},
+		StatePath:        statePath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nativeTun := tun.(*NativeTun)
+	rules, err := nlHandle.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsRuleProtocol(rules) {
+		t.Fatal("no rules were added")
+	}
+	if forward() != "1" {
+		t.Fatal("ip_forward was not enabled")
+	}
+
+	// a crash releases the device but none of the other changes
+	for _, file := range nativeTun.files() {
+		file.Close()
+	}
+	closeNetNS(nativeTun.netNS, nativeTun.nlHandle)
+	rules, err = nlHandle.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := tableRoutes(nlHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsRuleProtocol(rules) || len(routes) == 0 {
+		t.Fatal("the rules and the kill switch routes did not survive the crash")
+	}
+
+	err = Cleanup(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err = nlHandle.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containsRuleProtocol(rules) {
+		t.Error("rules were not removed")
+	}
+	routes, err = tableRoutes(nlHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) > 0 {
+		t.Errorf("routes %v were not removed", routes)
+	}
+	if value := forward(); value != previousForward {
+		t.Errorf("restored ip_forward %s, expected %s", value, previousForward)
+	}
+	_, err = os.Stat(statePath)
+	if !os.IsNotExist(err) {
+		t.Errorf("state file was not removed: %v", err)
+	}
+}
+
+func containsRuleProtocol(rules []netlink.Rule) bool {
+	for _, rule := range rules {
+		if rule.Protocol == ruleProtocol {
+			return true
+		}
+	}
+	return false
+}
+
+func tableRoutes(nlHandle *netlink.Handle) ([]netlink.Route, error) {
+	return nlHandle.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: DefaultIPRoute2TableIndex}, netlink.RT_FILTER_TABLE)
+}
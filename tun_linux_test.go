@@ -0,0 +1,249 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNewFromFD(t *testing.T) {
+	ns, _ := newTestNetNS(t)
+	var fd int
+	err := inNetNS(ns, func() (err error) {
+		fd, err = open("tun6", unix.IFF_VNET_HDR)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := &Options{Name: "tun0", FileDescriptor: &fd, AutoRoute: true}
+	tun, err := New(options)
+	if err != nil {
+		unix.Close(fd)
+		t.Fatal(err)
+	}
+	nativeTun := tun.(*NativeTun)
+	if nativeTun.options.Name != "tun6" || !nativeTun.vnetHdr {
+		t.Errorf("unexpected name %s or vnet header %v", nativeTun.options.Name, nativeTun.vnetHdr)
+	}
+	if options.Name != "tun0" {
+		t.Error("the options of the caller were changed")
+	}
+	if !errors.Is(nativeTun.MonitorLink(nil), ErrMonitorAdopted) {
+		t.Error("monitored an adopted device")
+	}
+	err = tun.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); !errors.Is(err, unix.EBADF) {
+		t.Error("the descriptor was not closed")
+	}
+}
+
+func TestOpenQueues(t *testing.T) {
+	ns, _ := newTestNetNS(t)
+	var fds []int
+	err := inNetNS(ns, func() (err error) {
+		fds, err = openQueues("tun5", 4, 0)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fds) != 4 {
+		t.Errorf("opened %d queues, expected 4", len(fds))
+	}
+	for _, fd := range fds {
+		name, flags, err := ifInfo(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "tun5" || flags&unix.IFF_MULTI_QUEUE == 0 {
+			t.Errorf("unexpected name %s or flags 0x%x", name, flags)
+		}
+		unix.Close(fd)
+	}
+
+	// the kernel allows at most 256 queues, and the queues opened before
+	// the failure are closed
+	openFds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	before := openFds()
+	err = inNetNS(ns, func() (err error) {
+		fds, err = openQueues("tun5", 257, 0)
+		return
+	})
+	if err == nil {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		t.Fatal("opened more queues than the kernel allows")
+	}
+	if after := openFds(); after != before {
+		t.Errorf("%d descriptors left open", after-before)
+	}
+}
+
+func TestSelectorRulesUID(t *testing.T) {
+	for _, test := range []struct {
+		options  Options
+		families []int
+		expected []string
+	}{
+		{
+			options:  Options{ExcludeUID: []UIDRange{{Start: 0, End: 0}}},
+			families: []int{unix.AF_INET},
+			expected: []string{
+				"ip rule add priority 10086 uidrange 0-0 goto 10096",
+			},
+		},
+		{
+			options:  Options{IncludeUID: []UIDRange{{Start: 1000, End: 1999}}},
+			families: []int{unix.AF_INET},
+			expected: []string{
+				"ip rule add priority 10086 uidrange 1000-1999 goto 10088",
+				"ip rule add priority 10087 goto 10096",
+			},
+		},
+		{
+			options: Options{
+				IncludeUID: []UIDRange{{Start: 1000, End: 1999}},
+				ExcludeUID: []UIDRange{{Start: 1500, End: 1500}},
+			},
+			families: []int{unix.AF_INET, unix.AF_INET6},
+			expected: []string{
+				"ip rule add priority 10086 uidrange 1500-1500 goto 10096",
+				"ip rule add priority 10086 uidrange 1000-1999 goto 10088",
+				"ip rule add priority 10087 goto 10096",
+				"ip -6 rule add priority 10086 uidrange 1500-1500 goto 10096",
+				"ip -6 rule add priority 10086 uidrange 1000-1999 goto 10088",
+				"ip -6 rule add priority 10087 goto 10096",
+			},
+		},
+	} {
+		tun := testTun(test.options)
+		commands := ruleCommands(tun.selectorRules(test.families, 10086, 10096))
+		if !slices.Equal(commands, test.expected) {
+			t.Errorf("unexpected rules for %+v:\n%s", test.options, strings.Join(commands, "\n"))
+		}
+	}
+}
+
+func TestSelectorRulesInterfaceAndSource(t *testing.T) {
+	for _, test := range []struct {
+		options  Options
+		families []int
+		expected []string
+	}{
+		{
+			options: Options{
+				ExcludeInterface: []string{"docker0"},
+				ExcludeSource:    []netip.Prefix{netip.MustParsePrefix("192.168.1.10/24"), netip.MustParsePrefix("fd00::/64")},
+			},
+			families: []int{unix.AF_INET, unix.AF_INET6},
+			expected: []string{
+				"ip rule add priority 10086 iif docker0 goto 10096",
+				"ip rule add priority 10086 from 192.168.1.0/24 goto 10096",
+				"ip -6 rule add priority 10086 iif docker0 goto 10096",
+				"ip -6 rule add priority 10086 from fd00::/64 goto 10096",
+			},
+		},
+		{
+			options: Options{
+				IncludeInterface: []string{"eth1"},
+				IncludeSource:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			},
+			families: []int{unix.AF_INET},
+			expected: []string{
+				"ip rule add priority 10086 iif eth1 goto 10088",
+				"ip rule add priority 10086 from 10.0.0.0/8 goto 10088",
+				"ip rule add priority 10087 goto 10096",
+			},
+		},
+		{
+			// the gateway interfaces are only included next to other
+			// include selectors
+			options: Options{
+				IncludeInterface: []string{"eth1"},
+				ExcludeSource:    []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+				GatewayInterface: []string{"eth2"},
+			},
+			families: []int{unix.AF_INET},
+			expected: []string{
+				"ip rule add priority 10086 from 10.0.0.1/32 goto 10096",
+				"ip rule add priority 10086 iif eth1 goto 10088",
+				"ip rule add priority 10086 iif eth2 goto 10088",
+				"ip rule add priority 10087 goto 10096",
+			},
+		},
+		{
+			options: Options{
+				ExcludeSource:    []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+				GatewayInterface: []string{"eth2"},
+			},
+			families: []int{unix.AF_INET},
+			expected: []string{
+				"ip rule add priority 10086 from 10.0.0.1/32 goto 10096",
+			},
+		},
+	} {
+		tun := testTun(test.options)
+		commands := ruleCommands(tun.selectorRules(test.families, 10086, 10096))
+		if !slices.Equal(commands, test.expected) {
+			t.Errorf("unexpected rules for %+v:\n%s", test.options, strings.Join(commands, "\n"))
+		}
+	}
+}
+
+func TestStrictRules(t *testing.T) {
+	tun := testTun(Options{
+		StrictRoute: true,
+		ExcludeUID:  []UIDRange{{Start: 1000, End: 1000}},
+	})
+	// IPv6 is blocked even without an IPv6 address
+	assertEqualCommands(t, ruleCommands(tun.rules()),
+		"ip rule add priority 10086 uidrange 1000-1000 goto 10096",
+		"ip -6 rule add priority 10086 uidrange 1000-1000 goto 10096",
+		"ip rule add priority 10088 to 198.18.0.0/16 lookup 4000",
+		"ip rule add priority 10089 lookup 4000 suppress_prefixlength 0",
+		"ip rule add priority 10090 iif tun0 goto 10096",
+		"ip rule add not priority 10091 iif lo lookup 4000",
+		"ip rule add priority 10091 from 0.0.0.0/32 iif lo lookup 4000",
+		"ip rule add priority 10091 from 198.18.0.0/16 iif lo lookup 4000",
+		"ip rule add priority 10093 unreachable",
+		"ip -6 rule add priority 10093 unreachable",
+		"ip rule add priority 10096 nop",
+		"ip -6 rule add priority 10096 nop",
+	)
+
+	// only RouteAddress is blocked
+	tun = testTun(Options{
+		StrictRoute:  true,
+		RouteAddress: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")},
+	})
+	assertEqualCommands(t, ruleCommands(tun.rules()),
+		"ip rule add priority 10086 to 198.18.0.0/16 lookup 4000",
+		"ip rule add priority 10087 lookup 4000 suppress_prefixlength 0",
+		"ip rule add priority 10088 iif tun0 goto 10096",
+		"ip rule add not priority 10089 iif lo lookup 4000",
+		"ip rule add priority 10089 from 0.0.0.0/32 iif lo lookup 4000",
+		"ip rule add priority 10089 from 198.18.0.0/16 iif lo lookup 4000",
+		"ip rule add priority 10091 to 10.0.0.0/8 unreachable",
+		"ip -6 rule add priority 10091 to fd00::/8 unreachable",
+		"ip rule add priority 10096 nop",
+		"ip -6 rule add priority 10096 nop",
+	)
+}
@@ -0,0 +1,138 @@
+//go:build linux
+
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// maxGSOSize is the largest packet the kernel accepts from a tun device
+// with IFF_VNET_HDR.
+const maxGSOSize = 65536
+
+const (
+	virtioNetHdrFNeedsCsum = 1
+	virtioNetHdrGSONone    = 0
+	virtioNetHdrGSOTCPv4   = 1
+	virtioNetHdrGSOTCPv6   = 4
+	virtioNetHdrGSOECN     = 0x80
+)
+
+var errVnetPacket = errors.New("malformed virtio-net packet")
+
+// vnetHeader is the virtio_net_hdr the kernel puts before every packet of a
+// tun device opened with IFF_VNET_HDR.
+type vnetHeader struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func parseVnetHeader(b []byte) vnetHeader {
+	return vnetHeader{
+		flags:      b[0],
+		gsoType:    b[1],
+		hdrLen:     binary.LittleEndian.Uint16(b[2:]),
+		gsoSize:    binary.LittleEndian.Uint16(b[4:]),
+		csumStart:  binary.LittleEndian.Uint16(b[6:]),
+		csumOffset: binary.LittleEndian.Uint16(b[8:]),
+	}
+}
+
+// vnetSegments calls yield with the packets the kernel would have sent
+// without the offloads of tunOffloadFlags, until it returns false: a
+// partial checksum is completed, and a TCP super-packet is split into
+// segments of gsoSize. Segments share one buffer, only valid until yield
+// returns.
+func vnetSegments(hdr vnetHeader, packet []byte, yield func([]byte) bool) error {
+	gsoType := hdr.gsoType &^ virtioNetHdrGSOECN
+	if gsoType == virtioNetHdrGSONone {
+		if hdr.flags&virtioNetHdrFNeedsCsum != 0 {
+			start, offset := int(hdr.csumStart), int(hdr.csumStart)+int(hdr.csumOffset)
+			if offset+2 > len(packet) {
+				return errVnetPacket
+			}
+			// the field holds the pseudo header sum, included in the sum
+			binary.BigEndian.PutUint16(packet[offset:], ^checksum.Checksum(packet[start:], 0))
+		}
+		yield(packet)
+		return nil
+	}
+	// UFO and USO are never enabled on the device
+	if gsoType != virtioNetHdrGSOTCPv4 && gsoType != virtioNetHdrGSOTCPv6 || hdr.gsoSize == 0 {
+		return errVnetPacket
+	}
+	is4 := header.IPVersion(packet) == header.IPv4Version
+	var ipHeaderLen int
+	switch {
+	case is4 && len(packet) >= header.IPv4MinimumSize:
+		ipHeaderLen = int(header.IPv4(packet).HeaderLength())
+	case header.IPVersion(packet) == header.IPv6Version:
+		ipHeaderLen = header.IPv6MinimumSize
+	default:
+		return errVnetPacket
+	}
+	// csum_start also skips IPv6 extension headers
+	if hdr.flags&virtioNetHdrFNeedsCsum != 0 {
+		ipHeaderLen = int(hdr.csumStart)
+	}
+	if len(packet) < ipHeaderLen+header.TCPMinimumSize {
+		return errVnetPacket
+	}
+	tcp := header.TCP(packet[ipHeaderLen:])
+	headerLen := ipHeaderLen + int(tcp.DataOffset())
+	if int(tcp.DataOffset()) < header.TCPMinimumSize || len(packet) < headerLen {
+		return errVnetPacket
+	}
+	sequenceNumber, flags := tcp.SequenceNumber(), tcp.Flags()
+	var id uint16
+	if is4 {
+		id = header.IPv4(packet).ID()
+	}
+	payload := packet[headerLen:]
+	segment := make([]byte, headerLen+int(hdr.gsoSize))
+	for i, offset := 0, 0; offset < len(payload); i++ {
+		n := min(int(hdr.gsoSize), len(payload)-offset)
+		segment = segment[:headerLen+n]
+		copy(segment, packet[:headerLen])
+		copy(segment[headerLen:], payload[offset:offset+n])
+		segmentFlags := flags
+		if offset+n < len(payload) {
+			segmentFlags &^= header.TCPFlagFin | header.TCPFlagPsh
+		}
+		if i > 0 {
+			segmentFlags &^= header.TCPFlagCwr
+		}
+		tcp = header.TCP(segment[ipHeaderLen:])
+		tcp.SetSequenceNumber(sequenceNumber + uint32(offset))
+		tcp.SetFlags(uint8(segmentFlags))
+		tcp.SetChecksum(0)
+		tcpLength := uint16(len(segment) - ipHeaderLen)
+		var pseudoHeaderSum uint16
+		if is4 {
+			ip := header.IPv4(segment)
+			ip.SetTotalLength(uint16(len(segment)))
+			ip.SetID(id + uint16(i))
+			ip.SetChecksum(0)
+			ip.SetChecksum(^ip.CalculateChecksum())
+			pseudoHeaderSum = header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), tcpLength)
+		} else {
+			ip := header.IPv6(segment)
+			ip.SetPayloadLength(uint16(len(segment) - header.IPv6MinimumSize))
+			pseudoHeaderSum = header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), tcpLength)
+		}
+		tcp.SetChecksum(^checksum.Checksum(segment[ipHeaderLen:], pseudoHeaderSum))
+		offset += n
+		if !yield(segment) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+//go:build linux
+
+package tun
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+
+	"golang.org/x/sys/unix"
+)
+
+// superPacket builds a TCP packet with the partial checksum the kernel
+// leaves in offloaded packets.
+func superPacket(source, destination netip.Addr, payload []byte, flags header.TCPFlags) ([]byte, int) {
+	var packet []byte
+	var ipHeaderLen int
+	srcAddr := tcpip.AddrFromSlice(source.AsSlice())
+	dstAddr := tcpip.AddrFromSlice(destination.AsSlice())
+	tcpLength := header.TCPMinimumSize + len(payload)
+	if source.Is4() {
+		ipHeaderLen = header.IPv4MinimumSize
+		packet = make([]byte, ipHeaderLen+tcpLength)
+		header.IPv4(packet).Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			ID:          100,
+			TTL:         64,
+			Protocol:    uint8(header.TCPProtocolNumber),
+			SrcAddr:     srcAddr,
+			DstAddr:     dstAddr,
+		})
+	} else {
+		ipHeaderLen = header.IPv6MinimumSize
+		packet = make([]byte, ipHeaderLen+tcpLength)
+		header.IPv6(packet).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(tcpLength),
+			TransportProtocol: header.TCPProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           srcAddr,
+			DstAddr:           dstAddr,
+		})
+	}
+	header.TCP(packet[ipHeaderLen:]).Encode(&header.TCPFields{
+		SrcPort:    1000,
+		DstPort:    2000,
+		SeqNum:     5000,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 1000,
+		Checksum:   header.PseudoHeaderChecksum(header.TCPProtocolNumber, srcAddr, dstAddr, uint16(tcpLength)),
+	})
+	copy(packet[ipHeaderLen+header.TCPMinimumSize:], payload)
+	return packet, ipHeaderLen
+}
+
+func assertTCPChecksum(t *testing.T, segment []byte, ipHeaderLen int, srcAddr, dstAddr tcpip.Address) {
+	t.Helper()
+	sum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, srcAddr, dstAddr, uint16(len(segment)-ipHeaderLen))
+	if checksum.Checksum(segment[ipHeaderLen:], sum) != 0xffff {
+		t.Error("invalid TCP checksum")
+	}
+}
+
+func TestVnetSegments(t *testing.T) {
+	payload := make([]byte, 2500)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	for _, addresses := range [][2]netip.Addr{
+		{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")},
+		{netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")},
+	} {
+		source, destination := addresses[0], addresses[1]
+		packet, ipHeaderLen := superPacket(source, destination, payload, header.TCPFlagAck|header.TCPFlagPsh|header.TCPFlagFin|header.TCPFlagCwr)
+		hdr := vnetHeader{
+			flags:      virtioNetHdrFNeedsCsum,
+			gsoType:    virtioNetHdrGSOTCPv4,
+			hdrLen:     uint16(ipHeaderLen + header.TCPMinimumSize),
+			gsoSize:    1000,
+			csumStart:  uint16(ipHeaderLen),
+			csumOffset: header.TCPChecksumOffset,
+		}
+		if source.Is6() {
+			hdr.gsoType = virtioNetHdrGSOTCPv6
+		}
+		var segments [][]byte
+		err := vnetSegments(hdr, packet, func(segment []byte) bool {
+			segments = append(segments, bytes.Clone(segment))
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 3 {
+			t.Fatalf("got %d segments, expected 3", len(segments))
+		}
+		var received []byte
+		for i, segment := range segments {
+			tcp := header.TCP(segment[ipHeaderLen:])
+			if expected := uint32(5000 + i*1000); tcp.SequenceNumber() != expected {
+				t.Errorf("segment %d: sequence number %d, expected %d", i, tcp.SequenceNumber(), expected)
+			}
+			flags := tcp.Flags()
+			if (i == 2) != flags.Contains(header.TCPFlagFin|header.TCPFlagPsh) || (i == 0) != flags.Contains(header.TCPFlagCwr) {
+				t.Errorf("segment %d: unexpected flags %s", i, flags)
+			}
+			if source.Is4() {
+				ip := header.IPv4(segment)
+				if int(ip.TotalLength()) != len(segment) || ip.ID() != uint16(100+i) || !ip.IsChecksumValid() {
+					t.Errorf("segment %d: invalid IPv4 header", i)
+				}
+			} else if int(header.IPv6(segment).PayloadLength()) != len(segment)-ipHeaderLen {
+				t.Errorf("segment %d: invalid IPv6 payload length", i)
+			}
+			assertTCPChecksum(t, segment, ipHeaderLen, tcpip.AddrFromSlice(source.AsSlice()), tcpip.AddrFromSlice(destination.AsSlice()))
+			received = append(received, segment[ipHeaderLen+header.TCPMinimumSize:]...)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Error("payload mismatch")
+		}
+	}
+}
+
+func TestVnetSegmentsChecksum(t *testing.T) {
+	source, destination := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	packet, ipHeaderLen := superPacket(source, destination, []byte("hello"), header.TCPFlagAck)
+	var segments int
+	err := vnetSegments(vnetHeader{
+		flags:      virtioNetHdrFNeedsCsum,
+		csumStart:  uint16(ipHeaderLen),
+		csumOffset: header.TCPChecksumOffset,
+	}, packet, func(segment []byte) bool {
+		segments++
+		assertTCPChecksum(t, segment, ipHeaderLen, tcpip.AddrFromSlice(source.AsSlice()), tcpip.AddrFromSlice(destination.AsSlice()))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segments != 1 {
+		t.Fatalf("got %d packets, expected 1", segments)
+	}
+	err = vnetSegments(vnetHeader{gsoType: 3, gsoSize: 1000}, packet, func([]byte) bool { return true })
+	if err == nil {
+		t.Error("expected an error for UDP fragmentation offload")
+	}
+}
+
+func TestVnetEndpointDetach(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	defer writer.Close()
+	endpoint := &VnetEndpoint{
+		GenericEndpoint: NewGenericEndpoint(nil, 0),
+		files:           []*os.File{reader},
+		dispatchers:     2,
+	}
+	endpoint.Attach(&countDispatcher{})
+	// the files stay open, as on relink, so the pending reads have to be
+	// woken by the detach
+	endpoint.Attach(nil)
+	waited := make(chan struct{})
+	go func() {
+		endpoint.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch loops did not stop after detach")
+	}
+}
+
+func TestVnetEndpointProcessors(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := os.NewFile(uintptr(fds[0]), "reader")
+	writer := os.NewFile(uintptr(fds[1]), "writer")
+	defer reader.Close()
+	defer writer.Close()
+	endpoint := &VnetEndpoint{
+		GenericEndpoint: NewGenericEndpoint(nil, 0),
+		files:           []*os.File{reader},
+		dispatchers:     4,
+	}
+	dispatcher := &countDispatcher{}
+	endpoint.Attach(dispatcher)
+	src := netip.MustParseAddrPort("198.18.0.2:40000")
+	dst := netip.MustParseAddrPort("1.1.1.1:53")
+	if flowHash(buildUDPPacket(src, dst, []byte("a"))) != flowHash(buildUDPPacket(src, dst, []byte("bb"))) {
+		t.Error("the packets of a connection have different hashes")
+	}
+	for i := 0; i < 16; i++ {
+		src = netip.AddrPortFrom(src.Addr(), src.Port()+1)
+		_, err = writer.Write(append(make([]byte, virtioNetHdrLen), buildUDPPacket(src, dst, []byte("hello"))...))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for dispatcher.packets.Load() < 16 {
+		if time.Now().After(deadline) {
+			t.Fatalf("delivered %d packets, expected 16", dispatcher.packets.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	endpoint.Attach(nil)
+	endpoint.Wait()
+}
@@ -3,45 +3,35 @@ package tun
 import (
 	"net/netip"
 	"runtime"
+
+	"github.com/josexy/cropstun/common/prefixset"
 )
 
 func (o *Options) BuildAutoRouteRanges() ([]netip.Prefix, error) {
 	var routeRanges []netip.Prefix
+	routeAddress := prefixset.New(o.RouteAddress...)
+	excludeAddress := prefixset.New(o.RouteExcludeAddress...)
 	if len(o.Inet4Address) > 0 {
-		var inet4Ranges []netip.Prefix
-		if runtime.GOOS == "darwin" {
-			inet4Ranges = []netip.Prefix{
-				netip.PrefixFrom(netip.AddrFrom4([4]byte{0: 1}), 8),
-				netip.PrefixFrom(netip.AddrFrom4([4]byte{0: 2}), 7),
-				netip.PrefixFrom(netip.AddrFrom4([4]byte{0: 4}), 6),
-				netip.PrefixFrom(netip.AddrFrom4([4]byte{0: 8}), 5),
-				netip.PrefixFrom(netip.AddrFrom4([4]byte{0: 16}), 4),
-				netip.PrefixFrom(netip.AddrFrom4([4]byte{0: 32}), 3),
-				netip.PrefixFrom(netip.AddrFrom4([4]byte{0: 64}), 2),
-				netip.PrefixFrom(netip.AddrFrom4([4]byte{0: 128}), 1),
-			}
-		} else {
-			inet4Ranges = []netip.Prefix{netip.PrefixFrom(netip.IPv4Unspecified(), 0)}
-		}
-		routeRanges = append(routeRanges, inet4Ranges...)
+		routeRanges = append(routeRanges, buildFamilyRanges(routeAddress, netip.IPv4Unspecified()).Subtract(excludeAddress).Prefixes()...)
 	}
 	if len(o.Inet6Address) > 0 {
-		var inet6Ranges []netip.Prefix
-		if runtime.GOOS == "darwin" {
-			inet6Ranges = []netip.Prefix{
-				netip.PrefixFrom(netip.AddrFrom16([16]byte{0: 1}), 8),
-				netip.PrefixFrom(netip.AddrFrom16([16]byte{0: 2}), 7),
-				netip.PrefixFrom(netip.AddrFrom16([16]byte{0: 4}), 6),
-				netip.PrefixFrom(netip.AddrFrom16([16]byte{0: 8}), 5),
-				netip.PrefixFrom(netip.AddrFrom16([16]byte{0: 16}), 4),
-				netip.PrefixFrom(netip.AddrFrom16([16]byte{0: 32}), 3),
-				netip.PrefixFrom(netip.AddrFrom16([16]byte{0: 64}), 2),
-				netip.PrefixFrom(netip.AddrFrom16([16]byte{0: 128}), 1),
-			}
-		} else {
-			inet6Ranges = []netip.Prefix{netip.PrefixFrom(netip.IPv6Unspecified(), 0)}
-		}
-		routeRanges = append(routeRanges, inet6Ranges...)
+		routeRanges = append(routeRanges, buildFamilyRanges(routeAddress, netip.IPv6Unspecified()).Subtract(excludeAddress).Prefixes()...)
 	}
 	return routeRanges, nil
 }
+
+// buildFamilyRanges returns the part of routeAddress in the family of
+// unspecified, or the whole family if there is none.
+func buildFamilyRanges(routeAddress *prefixset.Set, unspecified netip.Addr) *prefixset.Set {
+	all := prefixset.New(netip.PrefixFrom(unspecified, 0))
+	ranges := routeAddress.Intersect(all)
+	if !ranges.IsEmpty() {
+		return ranges
+	}
+	if runtime.GOOS == "darwin" {
+		// a default route would replace the system one, so cover everything
+		// but the first /8 with more specific routes instead
+		return all.Subtract(prefixset.New(netip.PrefixFrom(unspecified, 8)))
+	}
+	return all
+}
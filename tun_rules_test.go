@@ -0,0 +1,84 @@
+package tun
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestBuildAutoRouteRanges(t *testing.T) {
+	inet4 := []netip.Prefix{netip.MustParsePrefix("198.18.0.1/16")}
+	inet6 := []netip.Prefix{netip.MustParsePrefix("fdfe:dcba:9876::1/126")}
+	for _, test := range []struct {
+		options  Options
+		expected []string
+	}{
+		{
+			// everything but RFC 1918
+			options: Options{
+				Inet4Address: inet4,
+				RouteAddress: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+				RouteExcludeAddress: []netip.Prefix{
+					netip.MustParsePrefix("10.0.0.0/8"),
+					netip.MustParsePrefix("172.16.0.0/12"),
+					netip.MustParsePrefix("192.168.0.0/16"),
+				},
+			},
+			expected: []string{
+				"0.0.0.0/5", "8.0.0.0/7", "11.0.0.0/8", "12.0.0.0/6", "16.0.0.0/4", "32.0.0.0/3",
+				"64.0.0.0/2", "128.0.0.0/3", "160.0.0.0/5", "168.0.0.0/6", "172.0.0.0/12",
+				"172.32.0.0/11", "172.64.0.0/10", "172.128.0.0/9", "173.0.0.0/8", "174.0.0.0/7",
+				"176.0.0.0/4", "192.0.0.0/9", "192.128.0.0/11", "192.160.0.0/13", "192.169.0.0/16",
+				"192.170.0.0/15", "192.172.0.0/14", "192.176.0.0/12", "192.192.0.0/10",
+				"193.0.0.0/8", "194.0.0.0/7", "196.0.0.0/6", "200.0.0.0/5", "208.0.0.0/4",
+				"224.0.0.0/3",
+			},
+		},
+		{
+			// adjacent ranges are merged before the exclusion
+			options: Options{
+				Inet4Address:        inet4,
+				RouteAddress:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/9"), netip.MustParsePrefix("10.128.0.0/9")},
+				RouteExcludeAddress: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/10")},
+			},
+			expected: []string{"10.64.0.0/10", "10.128.0.0/9"},
+		},
+		{
+			// ranges of a family without an address are skipped
+			options: Options{
+				Inet6Address:        inet6,
+				RouteAddress:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")},
+				RouteExcludeAddress: []netip.Prefix{netip.MustParsePrefix("fd00::/9")},
+			},
+			expected: []string{"fd80::/9"},
+		},
+		{
+			options: Options{
+				Inet4Address:        inet4,
+				Inet6Address:        inet6,
+				RouteAddress:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::/0")},
+				RouteExcludeAddress: []netip.Prefix{netip.MustParsePrefix("10.255.255.255/32"), netip.MustParsePrefix("8000::/1")},
+			},
+			expected: []string{
+				"10.0.0.0/9", "10.128.0.0/10", "10.192.0.0/11", "10.224.0.0/12", "10.240.0.0/13",
+				"10.248.0.0/14", "10.252.0.0/15", "10.254.0.0/16", "10.255.0.0/17", "10.255.128.0/18",
+				"10.255.192.0/19", "10.255.224.0/20", "10.255.240.0/21", "10.255.248.0/22",
+				"10.255.252.0/23", "10.255.254.0/24", "10.255.255.0/25", "10.255.255.128/26",
+				"10.255.255.192/27", "10.255.255.224/28", "10.255.255.240/29", "10.255.255.248/30",
+				"10.255.255.252/31", "10.255.255.254/32", "::/1",
+			},
+		},
+	} {
+		ranges, err := test.options.BuildAutoRouteRanges()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, routeRange := range ranges {
+			got = append(got, routeRange.String())
+		}
+		if !slices.Equal(got, test.expected) {
+			t.Errorf("unexpected ranges %v, expected %v", got, test.expected)
+		}
+	}
+}
@@ -124,9 +124,9 @@ func (t *NativeTun) configure() error {
 			} else {
 				err = luid.AddRoute(routeRange, netip.IPv6Unspecified(), 0)
 			}
-		}
-		if err != nil {
-			return err
+			if err != nil {
+				return err
+			}
 		}
 		err = windnsapi.FlushResolverCache()
 		if err != nil {